@@ -0,0 +1,92 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/avidal/maptorio"
+)
+
+// archivePath returns the path of the tile archive for a surface of the map
+// in od, eg: maptorio-railworld/maptorio-railworld-nauvis.mbtiles
+func archivePath(od string, s surface, ext string) string {
+	return filepath.Join(od, filepath.Base(od)+"-"+s.Dir+"."+ext)
+}
+
+// openArchive opens the MBTiles archive for a surface of the map in od. If
+// there are screenshots in od/tiles they replace the archive's source level,
+// otherwise the archive is used as it is.
+func openArchive(ctx context.Context, config iniconfig, od string, s surface) (*maptorio.MBTilesStore, error) {
+	var path = archivePath(od, s, "mbtiles")
+	fmt.Printf("Writing tiles to %s\n", path)
+
+	var archive, err = maptorio.OpenMBTiles(path)
+	if err != nil {
+		return nil, err
+	}
+
+	var tiles = filepath.Join(od, "tiles", s.Dir)
+	if _, err = os.Stat(filepath.Join(tiles, strconv.Itoa(config.baseZoom()))); os.IsNotExist(err) {
+		fmt.Println("No screenshots found, using the tiles already in the archive")
+		return archive, nil
+	}
+
+	var screenshots = maptorio.NewDirStore(tiles, config.format.Ext())
+	if err = maptorio.CopyLevel(ctx, archive, screenshots, config.baseZoom()); err != nil {
+		archive.Close()
+		return nil, err
+	}
+
+	return archive, nil
+}
+
+// closeArchive records the metadata for a finished surface in the archive and
+// closes it, packing it into a PMTiles archive first if that's the configured
+// format. The surface's loose tiles in od are removed since everything is in
+// the archive now.
+func closeArchive(archive *maptorio.MBTilesStore, config iniconfig, od string, s surface) error {
+	var minZoom, bounds, err = maptorio.Extent(archive, config.baseZoom())
+	if err != nil {
+		archive.Close()
+		return err
+	}
+
+	var meta = maptorio.Metadata{
+		Name:     strings.TrimPrefix(filepath.Base(od), "maptorio-") + " " + s.Name,
+		Format:   config.format,
+		TileSize: config.Resolution,
+		MinZoom:  minZoom,
+		MaxZoom:  config.baseZoom(),
+		Bounds:   bounds,
+	}
+
+	err = archive.WriteMetadata(meta)
+
+	// The mbtiles archive is kept alongside the pmtiles one, since that's what the next
+	// render of this save rebuilds from
+	if err == nil && config.TileArchive == "pmtiles" {
+		var path = archivePath(od, s, "pmtiles")
+		fmt.Printf("Packing tiles into %s\n", path)
+		err = maptorio.WritePMTiles(path, archive, meta)
+	}
+
+	if cerr := archive.Close(); err == nil {
+		err = cerr
+	}
+
+	if err != nil {
+		return err
+	}
+
+	if err = os.RemoveAll(filepath.Join(od, "tiles", s.Dir)); err != nil {
+		return err
+	}
+
+	// Only goes once every surface is in an archive
+	os.Remove(filepath.Join(od, "tiles"))
+	return nil
+}
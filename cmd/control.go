@@ -0,0 +1,631 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"text/template"
+)
+
+// controlData is everything the control.lua template needs from the config.
+type controlData struct {
+	// Resolution is the width and height of each screenshot in pixels, and
+	// Zoom is the in-game zoom that makes a screenshot of that size cover
+	// exactly one chunk
+	Resolution int
+	Zoom       string
+
+	// BaseZoom is the zoom level the screenshots are the tiles for
+	BaseZoom int
+
+	GrowChunks int
+	FillHoles  int
+
+	// Forces own the entities that put a chunk on the map, every force but the
+	// enemy and neutral ones if it's empty. Only entities of IncludeTypes count
+	// if it's set, and ExcludeTypes never do.
+	Forces       []string
+	IncludeTypes []string
+	ExcludeTypes []string
+
+	// Region is the only part of the map screenshots are taken of, if it's set
+	Region *region
+
+	// Overlays are the groups of entities written out for the viewer
+	Overlays []string
+
+	// ShowEntityInfo turns on alt-mode in the screenshots, and Daytime is the
+	// game's daytime for the configured time of day
+	ShowEntityInfo bool
+	Daytime        string
+
+	Ext     string
+	Quality int
+}
+
+// writeControl renders the control.lua for the maptorio mod into path.
+func writeControl(path string, c iniconfig) error {
+	// At zoom 1 the game draws 32 pixels per tile, so a 1024 pixel screenshot is one chunk
+	var data = controlData{
+		Resolution: c.Resolution,
+		Zoom:       strconv.FormatFloat(float64(c.Resolution)/1024, 'f', -1, 64),
+		BaseZoom:   c.baseZoom(),
+		GrowChunks: c.GrowChunks,
+		FillHoles:  c.FillHoles,
+
+		Forces:       parseList(c.Forces),
+		IncludeTypes: parseList(c.IncludeEntityTypes),
+		ExcludeTypes: parseList(c.ExcludeEntityTypes),
+		Region:       c.region,
+		Overlays:     parseOverlays(c.Overlays),
+
+		ShowEntityInfo: c.ShowEntityInfo,
+		Daytime:        strconv.FormatFloat(float64((c.TimeOfDay+12)%24)/24, 'f', -1, 64),
+	}
+
+	// Blank is what the map was before forces could be picked, and * is all of them
+	if len(data.Forces) == 0 {
+		data.Forces = []string{"player"}
+	} else if len(data.Forces) == 1 && data.Forces[0] == "*" {
+		data.Forces = nil
+	}
+
+	// An excluded type that's also included just isn't included, which saves the mod counting it twice
+	if len(data.IncludeTypes) > 0 {
+		var types []string
+		for _, t := range data.IncludeTypes {
+			if !contains(data.ExcludeTypes, t) {
+				types = append(types, t)
+			}
+		}
+
+		data.IncludeTypes, data.ExcludeTypes = types, nil
+		if len(types) == 0 {
+			return fmt.Errorf("every type in include-entity-types is excluded by exclude-entity-types")
+		}
+	}
+
+	// The game can only write jpg and png screenshots, jpg being the only one with a quality setting
+	var shot = screenshotFormat(c.format)
+	data.Ext = shot.Ext()
+	if shot.Ext() == "jpg" {
+		data.Quality = c.TileQuality
+	}
+
+	var out, err = os.Create(path)
+	if err != nil {
+		return err
+	}
+
+	if err = controlTemplate.Execute(out, data); err != nil {
+		out.Close()
+		return err
+	}
+
+	return out.Close()
+}
+
+func contains(list []string, s string) bool {
+	for _, item := range list {
+		if item == s {
+			return true
+		}
+	}
+
+	return false
+}
+
+// luaString quotes s as a lua string literal. Lua strings are bytes, so only
+// the quotes, backslashes and line breaks need escaping.
+func luaString(s string) string {
+	return `"` + strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`, "\r", `\r`).Replace(s) + `"`
+}
+
+var controlTemplate = template.Must(template.New("control.lua").Funcs(template.FuncMap{"lua": luaString}).Parse(`
+-- maptorio-control.lua
+
+-- number of chunks around a chunk with built entities in it (see forces and the entity types below) that are rendered as well
+local grow_chunks = {{.GrowChunks}}
+
+-- largest group of unrendered chunks, surrounded by rendered chunks, that is rendered anyway; 0 leaves them all out
+local max_hole = {{.FillHoles}}
+
+-- forces whose entities put a chunk on the map; nil is every force but the enemy and neutral ones
+local forces = {{if .Forces}}{ {{- range $i, $f := .Forces}}{{if $i}}, {{end}}{{lua $f}}{{end -}} }{{else}}nil{{end}}
+
+-- entity types that count towards putting a chunk on the map (nil is every type), and types that never do
+local include_types = {{if .IncludeTypes}}{ {{- range $i, $t := .IncludeTypes}}{{if $i}}, {{end}}{{lua $t}}{{end -}} }{{else}}nil{{end}}
+local exclude_types = { {{- range $i, $t := .ExcludeTypes}}{{if $i}}, {{end}}{{lua $t}}{{end -}} }
+
+-- overlays to write the entities for, see overlay_types
+local overlays = { {{- range $i, $o := .Overlays}}{{if $i}}, {{end}}{{lua $o}}{{end -}} }
+
+-- the chunks screenshots are limited to, right and bottom included; nil is the whole map
+{{- with .Region}}
+local region = { left={{.Left}}, top={{.Top}}, right={{.Right}}, bottom={{.Bottom}} }
+{{- else}}
+local region = nil
+{{- end}}
+
+local ticks = 0
+script.on_init(function()
+    script.on_event(defines.events.on_tick, function()
+        ticks = ticks + 1
+        -- wait one tick before starting to avoid crashing!
+        if ticks == 1 then
+            generate()
+        end
+    end)
+end)
+
+-- write_file writes data to path in script-output, appending to it if append is true. 2.0 moved write_file from game
+-- to helpers
+function write_file(path, data, append)
+    if helpers and helpers.write_file then
+        helpers.write_file(path, data, append)
+    else
+        game.write_file(path, data, append)
+    end
+end
+
+function generate()
+    -- When the game is initialized, take screenshots
+    -- The screenshots are taken per-chunk at {{.Resolution}}x{{.Resolution}} at zoom {{.Zoom}}, which means each screenshot will cover
+    -- exactly 32x32 game tiles.
+    -- Every surface is mapped, not just the one a player happens to be on, and there may not be any players at all
+
+    local log = {}
+    local owners = resolve_forces(log)
+    resolve_types(log)
+
+    -- Plan every screenshot up front so the manifest, which tells maptorio what to wait for, is written before any
+    -- of them are taken
+    local surfaces = {}
+    local total = 0
+    for _, surface in pairs(game.surfaces) do
+        -- Surfaces nobody has built on, like a planet that's never been visited, are left off the map
+        local planned = plan_surface(surface, owners, log)
+        if #planned > 0 then
+            table.insert(surfaces, { surface = surface, planned = planned })
+            total = total + #planned
+        end
+    end
+
+    assign_dirs(surfaces)
+
+    write_manifest(surfaces)
+    write_entities(surfaces, owners, log)
+    write_search(surfaces, owners)
+
+    local i = 0
+    for _, s in ipairs(surfaces) do
+        local surface = s.surface
+
+        -- daytime runs from 0 at noon to 0.5 at midnight; stop the clock so every screenshot has the same light
+        surface.always_day = false
+        surface.daytime = {{.Daytime}}
+        surface.freeze_daytime = true
+
+        for _, chunk in ipairs(s.planned) do
+            i = i + 1
+            table.insert(log, "surface=" .. surface.name .. "; chunk=" .. chunk.x .. "x" .. chunk.y .. "y" .. "; rendering at position=" .. chunk.position.x .. "x" .. chunk.position.y)
+
+            game.take_screenshot({
+                surface=surface,
+                show_entity_info={{.ShowEntityInfo}},
+                position=chunk.position,
+                resolution={ {{- .Resolution}},{{.Resolution -}} },
+                zoom={{.Zoom}},
+                {{- if .Quality}}
+                quality={{.Quality}},
+                {{- end}}
+                path="tiles/" .. s.dir .. "/{{.BaseZoom}}/" .. chunk.x .. "x" .. chunk.y .. ".{{.Ext}}"
+            })
+
+            if i % 100 == 0 then
+                write_file("maptorio/progress", "requested " .. i .. "\n", true)
+            end
+        end
+    end
+
+    write_file("log", table.concat(log, "\n"))
+    write_file("maptorio/progress", "done " .. total .. "\n", true)
+end
+
+-- resolve_forces returns the forces in this save whose entities put a chunk on the map
+function resolve_forces(log)
+    local owners = {}
+
+    if forces == nil then
+        for name, _ in pairs(game.forces) do
+            if name ~= "enemy" and name ~= "neutral" then
+                table.insert(owners, name)
+            end
+        end
+    else
+        for _, name in ipairs(forces) do
+            if game.forces[name] then
+                table.insert(owners, name)
+            else
+                table.insert(log, "force=" .. name .. "; not in this save, skipping.")
+            end
+        end
+    end
+
+    table.insert(log, "forces=" .. table.concat(owners, ","))
+    return owners
+end
+
+-- resolve_types drops any entity types the game doesn't know about from include_types and exclude_types, since
+-- filtering on them is an error
+function resolve_types(log)
+    if include_types then
+        include_types = known_types(include_types, log)
+    end
+
+    exclude_types = known_types(exclude_types, log)
+end
+
+-- known_types returns the entity types in types that the game knows about, any others are mods that aren't loaded or
+-- typos
+local entity_types = nil
+function known_types(types, log)
+    if not entity_types then
+        entity_types = {}
+        local entities = prototypes and prototypes.entity or game.entity_prototypes
+        for _, prototype in pairs(entities) do
+            entity_types[prototype.type] = true
+        end
+    end
+
+    local kept = {}
+    for _, t in ipairs(types) do
+        if entity_types[t] then
+            table.insert(kept, t)
+        else
+            table.insert(log, "type=" .. t .. "; not an entity type, skipping.")
+        end
+    end
+
+    return kept
+end
+
+-- count_built returns how many entities in area count towards putting a chunk on the map
+function count_built(surface, area, owners)
+    if #owners == 0 or (include_types and #include_types == 0) then
+        return 0
+    end
+
+    local filter = { area=area, force=owners, type=include_types }
+    if #exclude_types == 0 then
+        filter.limit = 1 -- no need to keep searching; we either find something or we don't
+        return surface.count_entities_filtered(filter)
+    end
+
+    -- Anything matching can be one of the excluded types, so those are taken back off
+    local count = surface.count_entities_filtered(filter)
+    if count > 0 then
+        filter.type = exclude_types
+        count = count - surface.count_entities_filtered(filter)
+    end
+
+    return count
+end
+
+-- plan_surface returns the chunks of surface that will be rendered, in order
+function plan_surface(surface, owners, log)
+    -- First, determine the boundaries of the entire map
+    local topleft = { x=0, y=0 }
+    local bottomright = { x=0, y=0 }
+
+    local total_chunks = 0
+    for chunk in surface.get_chunks() do
+        if surface.is_chunk_generated(chunk) then
+            topleft.x = math.min(topleft.x, chunk.x)
+            topleft.y = math.min(topleft.y, chunk.y)
+            bottomright.x = math.max(bottomright.x, chunk.x)
+            bottomright.y = math.max(bottomright.y, chunk.y)
+            total_chunks = total_chunks + 1
+        end
+    end
+
+    table.insert(log, "surface=" .. surface.name .. "; chunks=" .. total_chunks .. "; topleft=" .. topleft.x .. "x" .. topleft.y .. "; bottomright=" .. bottomright.x .. "x" .. bottomright.y)
+
+    -- Now, topleft and bottomright contain *chunk* positions, not actual *positions*, which are game tiles
+    -- This means that we will need to multiply chunk coordinates by 32 to get the origin position
+    -- And we can iterate from top to bottom with one chunk of padding to make sure we get all of them.
+    local left, top, right, bottom = topleft.x-1, topleft.y-1, bottomright.x+1, bottomright.y+1
+
+    -- Nothing outside the region is looked at, so it's as if the map ended at its edges
+    if region then
+        left, top = math.max(left, region.left), math.max(top, region.top)
+        right, bottom = math.min(right, region.right), math.min(bottom, region.bottom)
+        table.insert(log, "surface=" .. surface.name .. "; region=" .. left .. "x" .. top .. " to " .. right .. "x" .. bottom)
+    end
+
+    -- chunks that will be rendered, keyed by chunk_key
+    local render = {}
+
+    for x = left, right, 1 do
+        for y = top, bottom, 1 do
+            local items = 0
+            local generated = surface.is_chunk_generated({x, y})
+
+            if not generated then
+                table.insert(log, "chunk=" .. x .. "x" .. y .. "y" .. "; not generated, skipping.")
+            else
+                -- if this chunk, or a chunk within grow_chunks of it, has any items in it, we'll render it
+                -- chunk x covers positions x * 32 up to (but not including) x * 32 + 32
+                local check_area = {
+                    top_left = { x = (x - grow_chunks) * 32, y = (y - grow_chunks) * 32 },
+                    bottom_right = { x = (x + grow_chunks + 1) * 32, y = (y + grow_chunks + 1) * 32 },
+                }
+                items = count_built(surface, check_area, owners)
+
+                table.insert(log, "chunk=" .. x .. "x" .. y .. "y" .. "; has " .. items .. " items.")
+            end
+
+            if items > 0 then
+                render[chunk_key(x, y)] = true
+            end
+        end
+    end
+
+    if max_hole > 0 then
+        fill_holes(surface, render, left, top, right, bottom, log)
+    end
+
+    local planned = {}
+    for x = left, right, 1 do
+        for y = top, bottom, 1 do
+            if render[chunk_key(x, y)] then
+                -- the screenshot is centered on the position, so aim for the middle of the chunk
+                table.insert(planned, { x = x, y = y, position = { x = x * 32 + 16, y = y * 32 + 16 } })
+            end
+        end
+    end
+
+    return planned
+end
+
+-- surface_dir returns the directory the tiles for the surface called name go in, which keeps letters, numbers,
+-- dashes and underscores and replaces anything else with an underscore
+function surface_dir(name)
+    return (string.gsub(name, "[^%w%-_]", "_"))
+end
+
+-- assign_dirs gives every surface its own directory. A name that's already a safe directory keeps it, and any other
+-- that surface_dir turns into one that's taken gets a number added, eg: "a b" goes in a_b-2 when there's also a
+-- surface called a_b. Directories are compared ignoring case, since some filesystems do
+function assign_dirs(surfaces)
+    local used = {}
+    for _, s in ipairs(surfaces) do
+        local name = s.surface.name
+        if surface_dir(name) == name and not used[string.lower(name)] then
+            s.dir = name
+            used[string.lower(name)] = true
+        end
+    end
+
+    for _, s in ipairs(surfaces) do
+        if not s.dir then
+            local base = surface_dir(s.surface.name)
+            local dir, n = base, 1
+            while used[string.lower(dir)] do
+                n = n + 1
+                dir = base .. "-" .. n
+            end
+
+            s.dir = dir
+            used[string.lower(dir)] = true
+        end
+    end
+end
+
+-- entity types for each overlay
+local overlay_types = {
+    ["train-stops"] = { "train-stop" },
+    ["combinators"] = { "constant-combinator", "arithmetic-combinator", "decider-combinator", "selector-combinator" },
+    ["assemblers"] = { "assembling-machine" },
+    ["roboports"] = { "roboport" },
+    ["radars"] = { "radar" },
+}
+
+-- entity_label returns what the entity is called or doing for an overlay, eg: a train stop's name or an assembler's
+-- recipe, or nil if there isn't anything
+function entity_label(overlay, entity)
+    if overlay == "train-stops" then
+        return entity.backer_name
+    elseif overlay == "assemblers" then
+        local recipe = entity.get_recipe()
+        return recipe and recipe.name
+    elseif overlay == "combinators" then
+        -- Only newer versions of the game let combinators be labelled
+        local ok, description = pcall(function() return entity.combinator_description end)
+        if ok and description ~= "" then
+            return description
+        end
+    end
+
+    return nil
+end
+
+-- write_entities writes the entities for each of the overlays on every surface as json, see entityDump in entities.go
+function write_entities(surfaces, owners, log)
+    if #overlays == 0 or #owners == 0 then
+        return
+    end
+
+    local area = region_area()
+    local entries = {}
+    for _, s in ipairs(surfaces) do
+        local entities = {}
+        for _, overlay in ipairs(overlays) do
+            local types = known_types(overlay_types[overlay], log)
+            if #types > 0 then
+                for _, entity in ipairs(s.surface.find_entities_filtered({ area=area, force=owners, type=types })) do
+                    local label = entity_label(overlay, entity)
+
+                    -- An assembler without a recipe or a combinator without a label isn't worth showing
+                    if label or (overlay ~= "assemblers" and overlay ~= "combinators") then
+                        table.insert(entities, string.format('{"overlay":%s,"type":%s,"name":%s,"force":%s,"x":%.2f,"y":%.2f,"label":%s}',
+                            json_string(overlay), json_string(entity.type), json_string(entity.name), json_string(entity.force.name),
+                            entity.position.x, entity.position.y, label and json_string(label) or '""'))
+                    end
+                end
+            end
+        end
+
+        table.insert(entries, string.format('{"name":%s,"dir":%s,"entities":[%s]}',
+            json_string(s.surface.name), json_string(s.dir), table.concat(entities, ",")))
+    end
+
+    write_file("maptorio/entities.json", string.format('{"surfaces":[%s]}', table.concat(entries, ",")))
+end
+
+-- region_area returns the area of the map in the region, or nil for the whole map
+function region_area()
+    if not region then
+        return nil
+    end
+
+    return { { region.left * 32, region.top * 32 }, { (region.right + 1) * 32, (region.bottom + 1) * 32 } }
+end
+
+-- in_area reports whether position is in area, where nil is the whole map
+function in_area(position, area)
+    return area == nil or (position.x >= area[1][1] and position.y >= area[1][2] and position.x < area[2][1] and position.y < area[2][2])
+end
+
+-- write_search writes the train stops, map tags and players on every surface as json for the viewer's search box,
+-- see searchDump in search.go
+function write_search(surfaces, owners)
+    local area = region_area()
+    local entries = {}
+
+    local function add(results, name, kind, position)
+        if name and name ~= "" then
+            table.insert(results, string.format('{"name":%s,"kind":"%s","x":%.2f,"y":%.2f}', json_string(name), kind, position.x, position.y))
+        end
+    end
+
+    for _, s in ipairs(surfaces) do
+        local results = {}
+
+        if #owners > 0 then
+            for _, stop in ipairs(s.surface.find_entities_filtered({ area=area, force=owners, type="train-stop" })) do
+                add(results, stop.backer_name, "train-stop", stop.position)
+            end
+        end
+
+        for _, owner in ipairs(owners) do
+            for _, tag in ipairs(game.forces[owner].find_chart_tags(s.surface, area)) do
+                add(results, tag.text, "tag", tag.position)
+            end
+        end
+
+        for _, player in pairs(game.players) do
+            if player.surface.index == s.surface.index and in_area(player.position, area) then
+                for _, owner in ipairs(owners) do
+                    if player.force.name == owner then
+                        add(results, player.name, "player", player.position)
+                    end
+                end
+            end
+        end
+
+        table.insert(entries, string.format('{"name":%s,"dir":%s,"results":[%s]}',
+            json_string(s.surface.name), json_string(s.dir), table.concat(results, ",")))
+    end
+
+    write_file("maptorio/search.json", string.format('{"surfaces":[%s]}', table.concat(entries, ",")))
+end
+
+-- json_string quotes s for use in json
+function json_string(s)
+    local quoted = string.gsub(s, '[%c"\\]', function(c)
+        if c == '"' or c == '\\' then
+            return '\\' .. c
+        end
+
+        return string.format('\\u%04x', string.byte(c))
+    end)
+
+    return '"' .. quoted .. '"'
+end
+
+-- write_manifest writes the planned screenshots for every surface as json, see renderManifest in progress.go
+function write_manifest(surfaces)
+    local entries = {}
+    for _, s in ipairs(surfaces) do
+        local chunks = {}
+        for _, chunk in ipairs(s.planned) do
+            table.insert(chunks, string.format('{"x":%d,"y":%d,"position":{"x":%d,"y":%d},"path":"tiles/%s/{{.BaseZoom}}/%dx%d.{{.Ext}}"}',
+                chunk.x, chunk.y, chunk.position.x, chunk.position.y, s.dir, chunk.x, chunk.y))
+        end
+
+        table.insert(entries, string.format('{"name":%s,"dir":%s,"chunks":[%s]}',
+            json_string(s.surface.name), json_string(s.dir), table.concat(chunks, ",")))
+    end
+
+    write_file("maptorio/manifest.json", string.format('{"zoom":{{.BaseZoom}},"resolution":{{.Resolution}},"surfaces":[%s]}',
+        table.concat(entries, ",")))
+end
+
+function chunk_key(x, y)
+    return x .. "x" .. y
+end
+
+-- fill_holes marks every generated chunk in a hole as rendered, where a hole is a group of unrendered chunks that is
+-- completely surrounded by rendered chunks and no bigger than max_hole chunks. Holes are found by flood filling
+-- each group of unrendered chunks within the box from left, top to right, bottom; any group that reaches the edge
+-- of the box is outside of the factory rather than a hole in it.
+function fill_holes(surface, render, left, top, right, bottom, log)
+    local seen = {}
+
+    for x = left, right, 1 do
+        for y = top, bottom, 1 do
+            local key = chunk_key(x, y)
+
+            if not render[key] and not seen[key] then
+                seen[key] = true
+
+                local group = {}
+                local edge = false
+                local queue = { { x = x, y = y } }
+                local head = 1
+
+                while head <= #queue do
+                    local c = queue[head]
+                    head = head + 1
+                    table.insert(group, c)
+
+                    if c.x == left or c.x == right or c.y == top or c.y == bottom then
+                        edge = true
+                    end
+
+                    for _, n in ipairs({ { x = c.x - 1, y = c.y }, { x = c.x + 1, y = c.y }, { x = c.x, y = c.y - 1 }, { x = c.x, y = c.y + 1 } }) do
+                        local nkey = chunk_key(n.x, n.y)
+                        if n.x >= left and n.x <= right and n.y >= top and n.y <= bottom and not render[nkey] and not seen[nkey] then
+                            seen[nkey] = true
+                            table.insert(queue, n)
+                        end
+                    end
+                end
+
+                if not edge and #group <= max_hole then
+                    table.insert(log, "hole at " .. x .. "x" .. y .. " of " .. #group .. " chunks, filling.")
+
+                    -- a hole can still contain chunks the game never generated, and there's nothing to screenshot there
+                    for _, c in ipairs(group) do
+                        if surface.is_chunk_generated({c.x, c.y}) then
+                            render[chunk_key(c.x, c.y)] = true
+                        end
+                    end
+                end
+            end
+        end
+    end
+end
+`))
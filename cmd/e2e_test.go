@@ -0,0 +1,303 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"image"
+	"image/jpeg"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sort"
+	"strings"
+	"testing"
+)
+
+// e2e runs the maptorio binary against fakefactorio, with everything it
+// reads and writes in a temporary directory.
+type e2e struct {
+	t        *testing.T
+	dir      string
+	maptorio string
+	factorio string
+	config   string
+	save     string
+}
+
+// newE2E builds maptorio and fakefactorio and creates a save made with
+// version of the game for them to render.
+func newE2E(t *testing.T, version string) *e2e {
+	if testing.Short() {
+		t.Skip("builds and runs the binaries")
+	}
+
+	var e = &e2e{t: t, dir: t.TempDir()}
+	e.maptorio = e.build(".", "maptorio")
+	e.factorio = e.build("./fakefactorio", "factorio")
+	e.save = filepath.Join(e.dir, "railworld.zip")
+
+	var cmd = exec.Command(e.factorio, "--create="+e.save)
+	cmd.Env = append(os.Environ(), "FAKE_FACTORIO_VERSION="+version)
+	if out, err := cmd.CombinedOutput(); err != nil {
+		t.Fatalf("creating a save: %s\n%s", err, out)
+	}
+
+	var mods = filepath.Join(e.dir, "mods")
+	for _, dir := range []string{mods, filepath.Join(e.dir, "tmp")} {
+		if err := os.MkdirAll(dir, os.ModePerm); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	e.config = filepath.Join(e.dir, "maptorio.conf")
+	writeFile(t, e.config, fmt.Sprintf(`screenshot-resolution = 512
+output-directory = %s
+temporary-directory = %s
+mod-directory = %s
+stall-timeout = 3
+`, filepath.Join(e.dir, "out"), filepath.Join(e.dir, "tmp"), mods))
+
+	return e
+}
+
+func (e *e2e) build(pkg, name string) string {
+	var path = filepath.Join(e.dir, "bin", name)
+	if out, err := exec.Command("go", "build", "-o", path, pkg).CombinedOutput(); err != nil {
+		e.t.Fatalf("building %s: %s\n%s", pkg, err, out)
+	}
+
+	return path
+}
+
+// run runs maptorio with args and the fake game's settings in env. It runs
+// from the top of the repository, where index.html and empty.jpg are.
+func (e *e2e) run(env []string, args ...string) (string, error) {
+	var cmd = exec.Command(e.maptorio, append([]string{"-c", e.config}, args...)...)
+	cmd.Dir = ".."
+	cmd.Env = append(append(os.Environ(), "FACTORIO_BIN="+e.factorio), env...)
+
+	var out, err = cmd.CombinedOutput()
+	return string(out), err
+}
+
+// od is the output directory for the save.
+func (e *e2e) od() string {
+	return filepath.Join(e.dir, "out", "maptorio-railworld")
+}
+
+func (e *e2e) readJSON(path string, v interface{}) {
+	var data, err = ioutil.ReadFile(filepath.Join(e.od(), path))
+	if err != nil {
+		e.t.Fatal(err)
+	}
+
+	if err = json.Unmarshal(data, v); err != nil {
+		e.t.Fatalf("%s: %s", path, err)
+	}
+}
+
+// checkTiles checks every level of the surface's tile pyramid, returning the
+// number of tiles in each.
+func (e *e2e) checkTiles(dir string) map[int]int {
+	var counts = map[int]int{}
+	var paths, _ = filepath.Glob(filepath.Join(e.od(), "tiles", dir, "*", "*.jpg"))
+	for _, path := range paths {
+		var z int
+		fmt.Sscanf(filepath.Base(filepath.Dir(path)), "%d", &z)
+		counts[z]++
+
+		var f, err = os.Open(path)
+		if err != nil {
+			e.t.Fatal(err)
+		}
+
+		var cfg image.Config
+		cfg, err = jpeg.DecodeConfig(f)
+		f.Close()
+		if err != nil || cfg.Width != 512 || cfg.Height != 512 {
+			e.t.Errorf("tile %s is %dx%d, %v; want a 512x512 jpeg", path, cfg.Width, cfg.Height, err)
+		}
+	}
+
+	return counts
+}
+
+func TestEndToEnd(t *testing.T) {
+	var e = newE2E(t, "1.1.100")
+
+	// a b and a_b end up in the same directory unless one of them is moved
+	var env = []string{"FAKE_FACTORIO_CHUNKS=2", "FAKE_FACTORIO_SURFACES=nauvis,a b,a_b"}
+	if out, err := e.run(env, "render", e.save); err != nil {
+		t.Fatalf("render: %s\n%s", err, out)
+	}
+
+	if out, err := e.run(nil, "mapgen", e.od()); err != nil {
+		t.Fatalf("mapgen: %s\n%s", err, out)
+	}
+
+	var surfaces []surface
+	e.readJSON("surfaces.json", &surfaces)
+
+	var want = []surface{{Name: "nauvis", Dir: "nauvis"}, {Name: "a b", Dir: "a_b-2"}, {Name: "a_b", Dir: "a_b"}}
+	if fmt.Sprint(surfaces) != fmt.Sprint(want) {
+		t.Fatalf("surfaces.json has %v, want %v", surfaces, want)
+	}
+
+	var index, err = ioutil.ReadFile(filepath.Join(e.od(), "index.html"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, s := range surfaces {
+		t.Run(s.Dir, func(t *testing.T) {
+			// 4x4 chunks of screenshots at zoom 9, folded into 2x2 at zoom 8 and so on
+			var counts = e.checkTiles(s.Dir)
+			if counts[9] != 16 || counts[8] != 4 {
+				t.Errorf("got %v tiles at each zoom level, want 16 at 9 and 4 at 8", counts)
+			}
+
+			for z := 8; z > 0 && counts[z-1] > 0; z-- {
+				if counts[z-1] > counts[z] {
+					t.Errorf("zoom %d has more tiles than zoom %d: %v", z-1, z, counts)
+				}
+			}
+
+			if _, err := os.Stat(filepath.Join(e.od(), "manifests", s.Dir+".json")); err != nil {
+				t.Errorf("no manifest: %s", err)
+			}
+
+			if _, err := os.Stat(filepath.Join(e.od(), "manifests", s.Dir+".json.partial")); !os.IsNotExist(err) {
+				t.Errorf("progress left behind after mapgen finished: %v", err)
+			}
+
+			if !strings.Contains(string(index), `"`+s.Dir+`"`) {
+				t.Errorf("index.html doesn't have surface %s", s.Dir)
+			}
+
+			var fc featureCollection
+			e.readJSON(filepath.Join("entities", s.Dir+".geojson"), &fc)
+			if fc.Type != "FeatureCollection" || len(fc.Features) == 0 {
+				t.Fatalf("entities for %s are a %s of %d features", s.Dir, fc.Type, len(fc.Features))
+			}
+
+			for _, f := range fc.Features {
+				var c = f.Geometry.Coordinates
+				if f.Geometry.Type != "Point" || c[0] != f.Properties.X/32 || c[1] != -f.Properties.Y/32 {
+					t.Errorf("entity %+v isn't at its position in the map", f)
+				}
+			}
+		})
+	}
+
+	var results []searchResult
+	e.readJSON("search.json", &results)
+
+	var kinds = map[string]bool{}
+	var dirs = map[string]bool{}
+	for _, r := range results {
+		kinds[r.Kind] = true
+		dirs[r.Surface] = true
+	}
+
+	if !kinds["train-stop"] || !kinds["tag"] || !kinds["player"] || len(dirs) != len(surfaces) {
+		t.Errorf("search.json has %v on %v, want train stops, tags and players on every surface", kinds, dirs)
+	}
+
+	if !sort.SliceIsSorted(results, func(i, j int) bool {
+		return strings.ToLower(results[i].Name) < strings.ToLower(results[j].Name)
+	}) {
+		t.Error("search.json isn't sorted by name")
+	}
+
+	// Nothing changed, so a second mapgen has nothing to build
+	if out, err := e.run(nil, "mapgen", e.od()); err != nil {
+		t.Fatalf("mapgen again: %s\n%s", err, out)
+	} else if strings.Count(out, "Found 0 changed source tiles") != len(surfaces) {
+		t.Errorf("mapgen again rebuilt tiles:\n%s", out)
+	}
+}
+
+func TestEndToEnd2(t *testing.T) {
+	// 2.0 moved some of what the mod uses, like write_file
+	var e = newE2E(t, "2.0.60")
+	var env = []string{"FAKE_FACTORIO_VERSION=2.0.60", "FAKE_FACTORIO_CHUNKS=1"}
+	if out, err := e.run(env, "render", e.save); err != nil {
+		t.Fatalf("render: %s\n%s", err, out)
+	}
+
+	var surfaces []surface
+	e.readJSON("surfaces.json", &surfaces)
+	if len(surfaces) != 1 || surfaces[0].Dir != "nauvis" {
+		t.Fatalf("surfaces.json has %v, want nauvis", surfaces)
+	}
+
+	var fc featureCollection
+	e.readJSON(filepath.Join("entities", "nauvis.geojson"), &fc)
+
+	var results []searchResult
+	e.readJSON("search.json", &results)
+	if len(fc.Features) == 0 || len(results) == 0 {
+		t.Errorf("got %d entities and %d search results, want some of each", len(fc.Features), len(results))
+	}
+}
+
+func TestEndToEndFailures(t *testing.T) {
+	var tests = []struct {
+		name    string
+		version string
+		fail    string
+		want    []string
+	}{
+		{
+			name: "stall",
+			fail: "hang",
+			want: []string{"the game stopped rendering, 8 of 16 screenshots were written in 3s"},
+		},
+		{
+			name: "crash",
+			fail: "crash",
+			want: []string{"factorio exited abnormally", "Probably the maptorio mod hit a script error", "Error while running event maptorio::on_tick"},
+		},
+		{
+			name: "missing mod",
+			fail: "mods",
+			want: []string{"Probably the save needs mods that couldn't be loaded", "Mod Bottleneck is missing"},
+		},
+		{
+			name: "video memory",
+			fail: "vram",
+			want: []string{"Probably the game ran out of video memory"},
+		},
+		{
+			name: "newer save",
+			fail: "version",
+			want: []string{"Probably the save was made with a newer version of factorio", "is higher than the game version"},
+		},
+		{
+			name:    "newer save than the game",
+			version: "2.0.60",
+			want:    []string{"the save was made with factorio 2.0.60 but the newest one installed is too old", "factorio (1.1.100)"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if tt.version == "" {
+				tt.version = "1.1.100"
+			}
+
+			var e = newE2E(t, tt.version)
+			var out, err = e.run([]string{"FAKE_FACTORIO_CHUNKS=2", "FAKE_FACTORIO_FAIL=" + tt.fail}, "render", e.save)
+			if err == nil {
+				t.Fatalf("render succeeded:\n%s", out)
+			}
+
+			for _, want := range tt.want {
+				if !strings.Contains(out, want) {
+					t.Errorf("output doesn't say %q:\n%s", want, out)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,123 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+)
+
+// overlayNames are the groups of entities the mod can write out for the
+// viewer to show on top of the map.
+var overlayNames = []string{"train-stops", "combinators", "assemblers", "roboports", "radars"}
+
+// parseOverlays returns the overlays in the overlays setting, where none is
+// none of them.
+func parseOverlays(s string) []string {
+	var overlays = parseList(s)
+	if len(overlays) == 1 && overlays[0] == "none" {
+		return nil
+	}
+
+	return overlays
+}
+
+// entityDump is what the mod writes to maptorio/entities.json in the script
+// output: the entities for each overlay, on every surface that was rendered.
+type entityDump struct {
+	Surfaces []struct {
+		surface
+
+		Entities []entity `json:"entities"`
+	} `json:"surfaces"`
+}
+
+// entity is one entity in the dump. X and Y are its position in the game,
+// and Label is whatever the overlay shows for it, eg: a train stop's name or
+// an assembler's recipe.
+type entity struct {
+	Overlay string  `json:"overlay"`
+	Type    string  `json:"type"`
+	Name    string  `json:"name"`
+	Force   string  `json:"force"`
+	X       float64 `json:"x"`
+	Y       float64 `json:"y"`
+	Label   string  `json:"label,omitempty"`
+}
+
+// featureCollection is a GeoJSON FeatureCollection of points.
+type featureCollection struct {
+	Type     string    `json:"type"`
+	Features []feature `json:"features"`
+}
+
+type feature struct {
+	Type     string `json:"type"`
+	Geometry struct {
+		Type        string     `json:"type"`
+		Coordinates [2]float64 `json:"coordinates"`
+	} `json:"geometry"`
+	Properties entity `json:"properties"`
+}
+
+// newFeature returns the GeoJSON point for e. The map is in L.CRS.Simple,
+// where one unit is one chunk (32 tiles in the game) with y going up the
+// screen, so that's the space the point is in too.
+func newFeature(e entity) feature {
+	var f = feature{Type: "Feature", Properties: e}
+	f.Geometry.Type = "Point"
+	f.Geometry.Coordinates = [2]float64{e.X / 32, -e.Y / 32}
+	return f
+}
+
+// entitiesPath returns the path of the GeoJSON for a surface of the map in od.
+func entitiesPath(od string, s surface) string {
+	return filepath.Join(od, "entities", s.Dir+".geojson")
+}
+
+// writeEntities converts the entities the mod wrote to the script output so
+// into a GeoJSON file for each surface of the map in od, replacing any from
+// before. Without a dump, eg: with no overlays configured, the map is left
+// without entities.
+func writeEntities(so, od string) error {
+	var dir = filepath.Join(od, "entities")
+	if err := os.RemoveAll(dir); err != nil {
+		return err
+	}
+
+	var data, err = ioutil.ReadFile(filepath.Join(so, "maptorio", "entities.json"))
+	if os.IsNotExist(err) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+
+	var dump entityDump
+	if err = json.Unmarshal(data, &dump); err != nil {
+		return fmt.Errorf("invalid entities from the mod: %s", err)
+	}
+
+	if err = os.MkdirAll(dir, os.ModePerm); err != nil {
+		return err
+	}
+
+	for _, s := range dump.Surfaces {
+		var fc = featureCollection{Type: "FeatureCollection", Features: make([]feature, 0, len(s.Entities))}
+		for _, e := range s.Entities {
+			fc.Features = append(fc.Features, newFeature(e))
+		}
+
+		if data, err = json.Marshal(fc); err != nil {
+			return err
+		}
+
+		if err = ioutil.WriteFile(entitiesPath(od, s.surface), data, 0644); err != nil {
+			return err
+		}
+
+		fmt.Printf("Found %d entities for the overlays on %s\n", len(s.Entities), s.Name)
+	}
+
+	return nil
+}
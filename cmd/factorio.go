@@ -0,0 +1,264 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"regexp"
+	"runtime"
+	"strings"
+
+	"github.com/avidal/maptorio"
+)
+
+// versionPattern matches the game's --version output, eg:
+// Version: 0.15.40 (build 30950, linux64, alpha)
+var versionPattern = regexp.MustCompile(`Version: (\d+\.\d+\.\d+) \(build (\d+)`)
+
+// binaryVersion runs the factorio binary at path with --version and returns
+// the version it reports.
+func binaryVersion(path string) (maptorio.Version, error) {
+	var cmd, err = gameCommand(path, "", "--version")
+	if err != nil {
+		return maptorio.Version{}, err
+	}
+
+	var out []byte
+	if out, err = cmd.Output(); err != nil {
+		return maptorio.Version{}, fmt.Errorf("error running %s --version: %s", path, err)
+	}
+
+	var m = versionPattern.FindSubmatch(out)
+	if m == nil {
+		return maptorio.Version{}, fmt.Errorf("unrecognized version output from %s: %q", path, out)
+	}
+
+	return maptorio.ParseVersion(string(m[1]) + "." + string(m[2]))
+}
+
+// checkVersion makes sure the factorio binary at path can load a save made
+// with the given version, which needs the same version of the game or newer.
+func checkVersion(path string, save maptorio.Version) error {
+	var v, err = binaryVersion(path)
+	if err != nil {
+		return err
+	}
+
+	if v.Release().Compare(save.Release()) < 0 {
+		return fmt.Errorf("factorio %s at %s is too old to load a save made with %s, install %s or newer and set binary-path to it", v, path, save, save)
+	}
+
+	fmt.Printf("Using factorio %s at %s\n", v, path)
+	return nil
+}
+
+// steamAppID is factorio's app id on Steam.
+const steamAppID = "427520"
+
+// isSteamInstall reports whether the factorio binary at path is part of a
+// Steam library rather than the standalone version.
+func isSteamInstall(path string) bool {
+	return strings.Contains(filepath.ToSlash(path), "/steamapps/common/")
+}
+
+// gameCommand returns the command to run the factorio binary at path with
+// args, in the directory dir if it isn't empty.
+//
+// A Steam copy of the game that isn't started by the Steam client hands off
+// to it and exits, which loses our arguments. Telling it which app it is, both
+// through the environment and a steam_appid.txt in its working directory,
+// makes it run as it is instead. Since we always pass --config, the game still
+// uses our config.ini and write-data rather than the ones Steam set up.
+func gameCommand(path, dir string, args ...string) (*exec.Cmd, error) {
+	var cmd = exec.Command(path, args...)
+	cmd.Dir = dir
+
+	if !isSteamInstall(path) {
+		return cmd, nil
+	}
+
+	if dir != "" {
+		if err := ioutil.WriteFile(filepath.Join(dir, "steam_appid.txt"), []byte(steamAppID), 0644); err != nil {
+			return nil, err
+		}
+	}
+
+	cmd.Env = append(os.Environ(), "SteamAppId="+steamAppID, "SteamGameId="+steamAppID)
+	return cmd, nil
+}
+
+// locator knows where factorio gets installed. Everything it looks at comes
+// from its fields, so it can be pointed at a fake directory tree.
+type locator struct {
+	Home   string
+	GOOS   string
+	Getenv func(string) string
+
+	// Roots are the game directories outside of Home, eg: /opt/factorio
+	Roots []string
+}
+
+func defaultLocator() locator {
+	var home, _ = os.UserHomeDir()
+	var l = locator{Home: home, GOOS: runtime.GOOS, Getenv: os.Getenv}
+
+	switch l.GOOS {
+	case "windows":
+		l.Roots = []string{filepath.Join(os.Getenv("ProgramFiles"), "Factorio")}
+	case "darwin":
+		l.Roots = []string{"/Applications"}
+	default:
+		l.Roots = []string{"/opt/factorio"}
+	}
+
+	return l
+}
+
+// executable returns the path of the binary inside the game directory dir.
+func (l locator) executable(dir string) string {
+	switch l.GOOS {
+	case "windows":
+		return filepath.Join(dir, "bin", "x64", "factorio.exe")
+	case "darwin":
+		return filepath.Join(dir, "factorio.app", "Contents", "MacOS", "factorio")
+	default:
+		return filepath.Join(dir, "bin", "x64", "factorio")
+	}
+}
+
+// steamRoots returns the directories Steam is installed to by default.
+func (l locator) steamRoots() []string {
+	switch l.GOOS {
+	case "windows":
+		return []string{filepath.Join(l.Getenv("ProgramFiles(x86)"), "Steam")}
+	case "darwin":
+		return []string{filepath.Join(l.Home, "Library", "Application Support", "Steam")}
+	default:
+		return []string{
+			filepath.Join(l.Home, ".steam", "steam"),
+			filepath.Join(l.Home, ".local", "share", "Steam"),
+			filepath.Join(l.Home, ".var", "app", "com.valvesoftware.Steam", ".local", "share", "Steam"),
+		}
+	}
+}
+
+// steamGames returns the Factorio directory in every Steam library, as listed
+// in each Steam install's libraryfolders.vdf.
+func (l locator) steamGames() []string {
+	var games []string
+	for _, root := range l.steamRoots() {
+		var libraries = []string{root}
+
+		var data, err = ioutil.ReadFile(filepath.Join(root, "steamapps", "libraryfolders.vdf"))
+		if err == nil {
+			libraries = append(libraries, parseLibraryFolders(data)...)
+		}
+
+		for _, lib := range libraries {
+			games = append(games, filepath.Join(lib, "steamapps", "common", "Factorio"))
+		}
+	}
+
+	return games
+}
+
+// libraryPatterns match a library folder in libraryfolders.vdf. Newer versions
+// of Steam list them as a "path" in a block per library, older ones as
+// numbered keys. The newer blocks also have numbered keys, for the apps in
+// each library, so the old form is only looked for without the new one.
+var libraryPatterns = []*regexp.Regexp{
+	regexp.MustCompile(`(?m)^\s*"path"\s+"(.+)"\s*$`),
+	regexp.MustCompile(`(?m)^\s*"\d+"\s+"(.+)"\s*$`),
+}
+
+// parseLibraryFolders returns the library folders listed in the contents of a
+// libraryfolders.vdf.
+func parseLibraryFolders(data []byte) []string {
+	var matches [][][]byte
+	for _, p := range libraryPatterns {
+		if matches = p.FindAllSubmatch(data, -1); matches != nil {
+			break
+		}
+	}
+
+	var folders []string
+	for _, m := range matches {
+		folders = append(folders, strings.Replace(string(m[1]), `\\`, `\`, -1))
+	}
+
+	return folders
+}
+
+// candidates returns every path the factorio binary might be at. If
+// FACTORIO_BIN is set it's the only one.
+func (l locator) candidates() []string {
+	if bin := l.Getenv("FACTORIO_BIN"); bin != "" {
+		return []string{bin}
+	}
+
+	var dirs = append([]string{}, l.Roots...)
+	switch l.GOOS {
+	case "windows":
+		// Nothing gets installed under the home directory
+	case "darwin":
+		dirs = append(dirs, filepath.Join(l.Home, "Applications"))
+	default:
+		dirs = append(dirs, filepath.Join(l.Home, ".factorio"))
+	}
+
+	// The standalone version unpacks to a factorio directory, which people tend
+	// to rename after the version when they keep more than one around
+	var unpacked, _ = filepath.Glob(filepath.Join(l.Home, "*actorio*"))
+	dirs = append(dirs, unpacked...)
+	dirs = append(dirs, l.steamGames()...)
+
+	var paths []string
+	var seen = make(map[string]bool)
+	for _, dir := range dirs {
+		var path = l.executable(dir)
+		if !seen[path] {
+			seen[path] = true
+			paths = append(paths, path)
+		}
+	}
+
+	return paths
+}
+
+// findBinary looks for every installed copy of factorio and returns the
+// newest one that can load a save made with the given version.
+func (l locator) findBinary(save maptorio.Version) (string, maptorio.Version, error) {
+	var best string
+	var bestVersion maptorio.Version
+	var found []string
+
+	for _, path := range l.candidates() {
+		if stat, err := os.Stat(path); err != nil || stat.IsDir() {
+			continue
+		}
+
+		var v, err = binaryVersion(path)
+		if err != nil {
+			fmt.Printf("Skipping %s: %s\n", path, err)
+			continue
+		}
+
+		found = append(found, fmt.Sprintf("%s (%s)", path, v))
+		if v.Compare(bestVersion) > 0 {
+			best, bestVersion = path, v
+		}
+	}
+
+	if best == "" {
+		return "", bestVersion, errors.New("couldn't find factorio, set binary-path in the config or FACTORIO_BIN to the factorio binary")
+	}
+
+	if bestVersion.Release().Compare(save.Release()) < 0 {
+		return "", bestVersion, fmt.Errorf("the save was made with factorio %s but the newest one installed is too old, found:\n  %s", save, strings.Join(found, "\n  "))
+	}
+
+	return best, bestVersion, nil
+}
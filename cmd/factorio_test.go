@@ -0,0 +1,264 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"runtime"
+	"strings"
+	"testing"
+
+	"github.com/avidal/maptorio"
+)
+
+// fakeGame installs a stand in for the game in the game directory dir that
+// reports version when run with --version, and returns the path to it.
+func fakeGame(t *testing.T, dir, version string) string {
+	if runtime.GOOS == "windows" {
+		t.Skip("the fake game is a shell script")
+	}
+
+	var path = filepath.Join(dir, "bin", "x64", "factorio")
+	if err := os.MkdirAll(filepath.Dir(path), os.ModePerm); err != nil {
+		t.Fatal(err)
+	}
+
+	var script = fmt.Sprintf("#!/bin/sh\necho 'Version: %s (build 60000, linux64, alpha)'\n", version)
+	if err := ioutil.WriteFile(path, []byte(script), 0755); err != nil {
+		t.Fatal(err)
+	}
+
+	return path
+}
+
+func writeFile(t *testing.T, path, data string) {
+	if err := os.MkdirAll(filepath.Dir(path), os.ModePerm); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := ioutil.WriteFile(path, []byte(data), 0644); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func mustVersion(t *testing.T, s string) maptorio.Version {
+	var v, err = maptorio.ParseVersion(s)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return v
+}
+
+func TestParseLibraryFolders(t *testing.T) {
+	var tests = []struct {
+		name string
+		vdf  string
+		want []string
+	}{
+		{
+			name: "numbered keys",
+			vdf: `"LibraryFolders"
+{
+	"TimeNextStatsReport"		"1560000000"
+	"ContentStatsID"		"-1234"
+	"1"		"/mnt/games/SteamLibrary"
+	"2"		"D:\\SteamLibrary"
+}`,
+			want: []string{"/mnt/games/SteamLibrary", `D:\SteamLibrary`},
+		},
+		{
+			name: "path blocks",
+			vdf: `"libraryfolders"
+{
+	"0"
+	{
+		"path"		"/home/user/.local/share/Steam"
+		"label"		""
+		"apps"
+		{
+			"427520"		"3000000000"
+		}
+	}
+	"1"
+	{
+		"path"		"/mnt/games/SteamLibrary"
+	}
+}`,
+			want: []string{"/home/user/.local/share/Steam", "/mnt/games/SteamLibrary"},
+		},
+		{
+			name: "empty",
+			vdf:  `"libraryfolders" {}`,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var got = parseLibraryFolders([]byte(tt.vdf))
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("got %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestFindBinary(t *testing.T) {
+	var tests = []struct {
+		name    string
+		setup   func(t *testing.T, root string, l *locator) string
+		save    string
+		version string
+		err     string
+	}{
+		{
+			name: "FACTORIO_BIN",
+			setup: func(t *testing.T, root string, l *locator) string {
+				fakeGame(t, filepath.Join(root, "opt", "factorio"), "2.0.60")
+				var bin = fakeGame(t, filepath.Join(root, "elsewhere"), "1.1.110")
+				l.Roots = []string{filepath.Join(root, "opt", "factorio")}
+				l.Getenv = func(key string) string {
+					if key == "FACTORIO_BIN" {
+						return bin
+					}
+
+					return ""
+				}
+
+				return bin
+			},
+			save:    "1.1.100",
+			version: "1.1.110",
+		},
+		{
+			name: "steam library",
+			setup: func(t *testing.T, root string, l *locator) string {
+				var library = filepath.Join(root, "mnt", "SteamLibrary")
+				writeFile(t, filepath.Join(l.Home, ".steam", "steam", "steamapps", "libraryfolders.vdf"),
+					fmt.Sprintf("\"libraryfolders\"\n{\n\t\"1\"\n\t{\n\t\t\"path\"\t\t\"%s\"\n\t}\n}\n", library))
+				return fakeGame(t, filepath.Join(library, "steamapps", "common", "Factorio"), "2.0.60")
+			},
+			save:    "2.0.60",
+			version: "2.0.60",
+		},
+		{
+			name: "newest of several",
+			setup: func(t *testing.T, root string, l *locator) string {
+				l.Roots = []string{filepath.Join(root, "opt", "factorio")}
+				fakeGame(t, l.Roots[0], "1.1.110")
+				fakeGame(t, filepath.Join(l.Home, "factorio-0.17"), "0.17.79")
+				return fakeGame(t, filepath.Join(l.Home, ".factorio"), "2.0.60")
+			},
+			save:    "1.1.100",
+			version: "2.0.60",
+		},
+		{
+			name: "too old",
+			setup: func(t *testing.T, root string, l *locator) string {
+				l.Roots = []string{filepath.Join(root, "opt", "factorio")}
+				fakeGame(t, l.Roots[0], "1.1.110")
+				return ""
+			},
+			save: "2.0.60",
+			err:  "too old",
+		},
+		{
+			name: "not installed",
+			setup: func(t *testing.T, root string, l *locator) string {
+				l.Roots = []string{filepath.Join(root, "opt", "factorio")}
+				return ""
+			},
+			save: "2.0.60",
+			err:  "couldn't find factorio",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var root = t.TempDir()
+			var l = locator{
+				Home:   filepath.Join(root, "home"),
+				GOOS:   "linux",
+				Getenv: func(string) string { return "" },
+			}
+
+			var want = tt.setup(t, root, &l)
+			var path, v, err = l.findBinary(mustVersion(t, tt.save))
+			if tt.err != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.err) {
+					t.Fatalf("got error %v, want one about %q", err, tt.err)
+				}
+
+				return
+			}
+
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if path != want || v.String() != tt.version {
+				t.Errorf("found %s (%s), want %s (%s)", path, v, want, tt.version)
+			}
+		})
+	}
+}
+
+func TestGameCommand(t *testing.T) {
+	var tests = []struct {
+		name  string
+		game  string
+		steam bool
+	}{
+		{"steam", filepath.Join("steamapps", "common", "Factorio"), true},
+		{"standalone", "factorio", false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var root = t.TempDir()
+			var path = fakeGame(t, filepath.Join(root, "library", tt.game), "2.0.60")
+			var workspace = filepath.Join(root, "workspace")
+			if err := os.MkdirAll(workspace, os.ModePerm); err != nil {
+				t.Fatal(err)
+			}
+
+			if isSteamInstall(path) != tt.steam {
+				t.Errorf("isSteamInstall(%s) = %t, want %t", path, !tt.steam, tt.steam)
+			}
+
+			var cmd, err = gameCommand(path, workspace, "--version")
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if cmd.Dir != workspace {
+				t.Errorf("runs in %s, want %s", cmd.Dir, workspace)
+			}
+
+			var env = map[string]bool{}
+			for _, kv := range cmd.Env {
+				env[kv] = true
+			}
+
+			for _, kv := range []string{"SteamAppId=" + steamAppID, "SteamGameId=" + steamAppID} {
+				if env[kv] != tt.steam {
+					t.Errorf("%s in the environment is %t, want %t", kv, env[kv], tt.steam)
+				}
+			}
+
+			var data, _ = ioutil.ReadFile(filepath.Join(workspace, "steam_appid.txt"))
+			if tt.steam && string(data) != steamAppID {
+				t.Errorf("steam_appid.txt has %q, want %q", data, steamAppID)
+			} else if !tt.steam && data != nil {
+				t.Error("steam_appid.txt written for a standalone install")
+			}
+
+			var out []byte
+			if out, err = cmd.Output(); err != nil || !strings.Contains(string(out), "2.0.60") {
+				t.Errorf("running it gave %q, %v", out, err)
+			}
+		})
+	}
+}
@@ -0,0 +1,710 @@
+// Command fakefactorio stands in for the game so maptorio can be run end to
+// end without it, eg: on a CI box without a GPU. It takes the same arguments
+// maptorio starts the game with, reads the generated mod to find out what to
+// write, and writes a screenshot for each chunk of a made up map into the
+// script output, along with the mod's manifest and progress markers and a
+// factorio-current.log. Then it waits to be stopped like the game does.
+//
+// It can also make a save for itself to load:
+//
+//	fakefactorio --create=save.zip
+//
+// The fake is controlled through the environment:
+//
+//	FAKE_FACTORIO_VERSION  version to report and write into saves (default 1.1.100)
+//	FAKE_FACTORIO_CHUNKS   chunks to render in each direction from 0x0 (default 2, ie: 4x4 chunks)
+//	FAKE_FACTORIO_SURFACES comma separated surfaces to render those chunks on (default nauvis)
+//	FAKE_FACTORIO_FAIL     fail the way the game does: version, mods, vram, crash or hang
+package main
+
+import (
+	"archive/zip"
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"image"
+	"image/color"
+	"image/jpeg"
+	"image/png"
+	"io/ioutil"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+
+	lua "github.com/yuin/gopher-lua"
+)
+
+// game is what the fake was asked to do, from its arguments and environment.
+type game struct {
+	version  string
+	chunks   int
+	surfaces []string
+	fail     string
+
+	config string
+	save   string
+	modDir string
+
+	log   *os.File
+	start time.Time
+}
+
+func main() {
+	var g = game{
+		version:  env("FAKE_FACTORIO_VERSION", "1.1.100"),
+		surfaces: strings.Split(env("FAKE_FACTORIO_SURFACES", "nauvis"), ","),
+		fail:     os.Getenv("FAKE_FACTORIO_FAIL"),
+		start:    time.Now(),
+	}
+
+	var err error
+	if g.chunks, err = strconv.Atoi(env("FAKE_FACTORIO_CHUNKS", "2")); err != nil {
+		fatal(fmt.Errorf("invalid FAKE_FACTORIO_CHUNKS: %s", err))
+	}
+
+	for _, arg := range os.Args[1:] {
+		var name, value = arg, ""
+		if i := strings.Index(arg, "="); i >= 0 {
+			name, value = arg[:i], arg[i+1:]
+		}
+
+		switch name {
+		case "--version":
+			fmt.Printf("Version: %s (build 1, linux64, headless)\n", g.version)
+			return
+		case "--create":
+			if err = createSave(value, g.version); err != nil {
+				fatal(err)
+			}
+			return
+		case "--config":
+			g.config = value
+		case "--load-game":
+			g.save = value
+		case "--mod-dir":
+			g.modDir = value
+		case "-v", "--disable-audio":
+		default:
+			fatal(fmt.Errorf("unknown argument %s", arg))
+		}
+	}
+
+	if g.config == "" || g.save == "" || g.modDir == "" {
+		fatal(fmt.Errorf("--config, --load-game and --mod-dir are required"))
+	}
+
+	if err = g.run(); err != nil {
+		g.logf("Error: %s", err)
+		fatal(err)
+	}
+
+	// The game keeps running after the mod is done, until maptorio stops it
+	var stop = make(chan os.Signal, 1)
+	signal.Notify(stop, os.Interrupt, syscall.SIGTERM)
+	<-stop
+}
+
+func (g *game) run() error {
+	var data, err = writeData(g.config)
+	if err != nil {
+		return err
+	}
+
+	if err = os.MkdirAll(data, os.ModePerm); err != nil {
+		return err
+	}
+
+	if g.log, err = os.Create(filepath.Join(data, "factorio-current.log")); err != nil {
+		return err
+	}
+
+	g.logf("Factorio %s (build 1, linux64, headless)", g.version)
+	g.logf("Write data path: %s", data)
+
+	if g.fail == "vram" {
+		return fmt.Errorf("Out of video memory while allocating a texture")
+	}
+
+	var mods []string
+	if mods, err = g.loadMods(); err != nil {
+		return err
+	}
+
+	g.logf("Loading map %s", g.save)
+	var version string
+	if version, err = saveVersion(g.save); err != nil {
+		return fmt.Errorf("Failed to load the save: %s", err)
+	}
+
+	if g.fail == "version" || compareVersions(version, g.version) > 0 {
+		return fmt.Errorf("Map version %s cannot be loaded because it is higher than the game version (%s)", version, g.version)
+	}
+
+	if g.fail == "mods" {
+		return fmt.Errorf("Mod Bottleneck is missing")
+	}
+
+	var control []byte
+	if control, err = ioutil.ReadFile(filepath.Join(g.modDir, "maptorio_0.0.0", "control.lua")); err != nil {
+		return err
+	}
+
+	g.logf("Loaded mods: %s", strings.Join(mods, ", "))
+
+	// 2.0 removed game.write_file, so only the mod's write_file, which checks
+	// for its replacement first, may still call it
+	var removed = compareVersions(g.version, "2.0.0") >= 0 &&
+		bytes.Contains(writeFilePattern.ReplaceAll(control, nil), []byte("game.write_file("))
+
+	if g.fail == "crash" || removed {
+		g.logf("Error while running event maptorio::on_tick (ID 0)")
+		g.logf("__maptorio__/control.lua:1: attempt to index a nil value")
+		os.Exit(1)
+	}
+
+	return g.screenshots(filepath.Join(data, "script-output"), control)
+}
+
+// loadMods checks the mod-list.json maptorio wrote enables the maptorio mod
+// and that every mod it enables is in the mod directory.
+func (g *game) loadMods() ([]string, error) {
+	var list struct {
+		Mods []struct {
+			Name    string `json:"name"`
+			Enabled bool   `json:"enabled"`
+		} `json:"mods"`
+	}
+
+	var data, err = ioutil.ReadFile(filepath.Join(g.modDir, "mod-list.json"))
+	if err != nil {
+		return nil, err
+	}
+
+	if err = json.Unmarshal(data, &list); err != nil {
+		return nil, fmt.Errorf("invalid mod-list.json: %s", err)
+	}
+
+	var entries []os.FileInfo
+	if entries, err = ioutil.ReadDir(g.modDir); err != nil {
+		return nil, err
+	}
+
+	var mods []string
+	for _, m := range list.Mods {
+		if !m.Enabled {
+			continue
+		}
+
+		var found = m.Name == "base"
+		for _, e := range entries {
+			if e.Name() == m.Name || strings.HasPrefix(e.Name(), m.Name+"_") {
+				found = true
+			}
+		}
+
+		if !found {
+			return nil, fmt.Errorf("Mod %s is missing", m.Name)
+		}
+
+		mods = append(mods, m.Name)
+	}
+
+	return mods, nil
+}
+
+// The parts of the generated control.lua the fake needs
+var (
+	resolutionPattern = regexp.MustCompile(`resolution=\{\s*(\d+),\s*(\d+)\s*\}`)
+	overlaysPattern   = regexp.MustCompile(`local overlays = \{(.*)\}`)
+	quotedPattern     = regexp.MustCompile(`"([^"]*)"`)
+	regionPattern     = regexp.MustCompile(`local region = \{ left=(-?\d+), top=(-?\d+), right=(-?\d+), bottom=(-?\d+) \}`)
+	pathPattern       = regexp.MustCompile(`"tiles/" \.\. s\.dir \.\. "/(\d+)/" \.\. chunk\.x \.\. "x" \.\. chunk\.y \.\. "\.(\w+)"`)
+)
+
+// writeFilePattern finds the mod's write_file.
+var writeFilePattern = regexp.MustCompile(`(?ms)^function write_file\(.*?^end$`)
+
+// dirsPattern finds the mod's surface_dir and assign_dirs, which are the
+// only functions in it the fake runs as they are.
+var dirsPattern = regexp.MustCompile(`(?ms)^function surface_dir\(.*?^end$.*?^function assign_dirs\(.*?^end$`)
+
+// assignDirs gives each surface the directory the mod would, by running the
+// mod's own assign_dirs on them.
+func assignDirs(control []byte, surfaces []surface) error {
+	var src = dirsPattern.Find(control)
+	if src == nil {
+		return fmt.Errorf("__maptorio__/control.lua:1: couldn't find assign_dirs")
+	}
+
+	var L = lua.NewState()
+	defer L.Close()
+
+	if err := L.DoString(string(src)); err != nil {
+		return fmt.Errorf("__maptorio__/control.lua: %s", err)
+	}
+
+	// The mod passes a list of { surface = LuaSurface } and reads back dir
+	var list = L.NewTable()
+	for _, s := range surfaces {
+		var surface = L.NewTable()
+		surface.RawSetString("name", lua.LString(s.Name))
+
+		var entry = L.NewTable()
+		entry.RawSetString("surface", surface)
+		list.Append(entry)
+	}
+
+	if err := L.CallByParam(lua.P{Fn: L.GetGlobal("assign_dirs"), Protect: true}, list); err != nil {
+		return fmt.Errorf("__maptorio__/control.lua: %s", err)
+	}
+
+	for i := range surfaces {
+		surfaces[i].Dir = lua.LVAsString(list.RawGetInt(i + 1).(*lua.LTable).RawGetString("dir"))
+	}
+
+	return nil
+}
+
+// The mod's manifest, see renderManifest in maptorio
+type point struct {
+	X int `json:"x"`
+	Y int `json:"y"`
+}
+
+type chunk struct {
+	point
+	Position point  `json:"position"`
+	Path     string `json:"path"`
+}
+
+type surface struct {
+	Name   string  `json:"name"`
+	Dir    string  `json:"dir"`
+	Chunks []chunk `json:"chunks"`
+}
+
+// screenshots does what the mod would have the game do: write the manifest,
+// then a screenshot of each chunk with progress markers along the way.
+func (g *game) screenshots(so string, control []byte) error {
+	var res = resolutionPattern.FindSubmatch(control)
+	var path = pathPattern.FindSubmatch(control)
+	if res == nil || path == nil {
+		return fmt.Errorf("__maptorio__/control.lua:1: couldn't find the screenshot settings")
+	}
+
+	var size, _ = strconv.Atoi(string(res[1]))
+	var zoom, _ = strconv.Atoi(string(path[1]))
+	var ext = string(path[2])
+
+	// Only chunks in the region, if there is one, are rendered
+	var inRegion = func(x, y int) bool { return true }
+	if m := regionPattern.FindSubmatch(control); m != nil {
+		var r [4]int
+		for i := range r {
+			r[i], _ = strconv.Atoi(string(m[i+1]))
+		}
+
+		inRegion = func(x, y int) bool { return x >= r[0] && y >= r[1] && x <= r[2] && y <= r[3] }
+	}
+
+	var surfaces []surface
+	for _, name := range g.surfaces {
+		var s = surface{Name: name}
+		for x := -g.chunks; x < g.chunks; x++ {
+			for y := -g.chunks; y < g.chunks; y++ {
+				if inRegion(x, y) {
+					s.Chunks = append(s.Chunks, chunk{point: point{x, y}, Position: point{x*32 + 16, y*32 + 16}})
+				}
+			}
+		}
+
+		// The mod leaves out surfaces with nothing to render
+		if len(s.Chunks) > 0 {
+			surfaces = append(surfaces, s)
+		}
+	}
+
+	if err := assignDirs(control, surfaces); err != nil {
+		return err
+	}
+
+	var chunks []chunk
+	for _, s := range surfaces {
+		for i := range s.Chunks {
+			var c = &s.Chunks[i]
+			c.Path = fmt.Sprintf("tiles/%s/%d/%dx%d.%s", s.Dir, zoom, c.X, c.Y, ext)
+		}
+
+		chunks = append(chunks, s.Chunks...)
+	}
+
+	var manifest, err = json.Marshal(map[string]interface{}{
+		"zoom":       zoom,
+		"resolution": size,
+		"surfaces":   surfaces,
+	})
+	if err != nil {
+		return err
+	}
+
+	if err = writeFile(filepath.Join(so, "maptorio", "manifest.json"), manifest); err != nil {
+		return err
+	}
+
+	if err = g.entities(so, control, surfaces); err != nil {
+		return err
+	}
+
+	if err = g.search(so, surfaces); err != nil {
+		return err
+	}
+
+	var progress []string
+	for i, c := range chunks {
+		if g.fail == "hang" && i == len(chunks)/2 {
+			g.logf("Stopped taking screenshots")
+			return nil
+		}
+
+		if err = writeFile(filepath.Join(so, filepath.FromSlash(c.Path)), screenshot(c.X, c.Y, size, ext)); err != nil {
+			return err
+		}
+
+		if (i+1)%100 == 0 {
+			progress = append(progress, fmt.Sprintf("requested %d\n", i+1))
+			if err = writeFile(filepath.Join(so, "maptorio", "progress"), []byte(strings.Join(progress, ""))); err != nil {
+				return err
+			}
+		}
+	}
+
+	progress = append(progress, fmt.Sprintf("done %d\n", len(chunks)))
+	if err = writeFile(filepath.Join(so, "maptorio", "progress"), []byte(strings.Join(progress, ""))); err != nil {
+		return err
+	}
+
+	g.logf("Took %d screenshots", len(chunks))
+	return nil
+}
+
+// overlayEntities are the made up entities the fake puts in every chunk for
+// each overlay: the type, name and label.
+var overlayEntities = map[string][3]string{
+	"train-stops": {"train-stop", "train-stop", "Stop %dx%d"},
+	"combinators": {"constant-combinator", "constant-combinator", "Signal %dx%d"},
+	"assemblers":  {"assembling-machine", "assembling-machine-2", "iron-gear-wheel"},
+	"roboports":   {"roboport", "roboport", ""},
+	"radars":      {"radar", "radar", ""},
+}
+
+// entities writes what the mod would for its overlays: an entity for each of
+// them in every chunk that has a screenshot.
+func (g *game) entities(so string, control []byte, surfaces []surface) error {
+	var list = overlaysPattern.FindSubmatch(control)
+	if list == nil {
+		return nil
+	}
+
+	var overlays []string
+	for _, m := range quotedPattern.FindAllSubmatch(list[1], -1) {
+		overlays = append(overlays, string(m[1]))
+	}
+
+	if len(overlays) == 0 {
+		return nil
+	}
+
+	type entity struct {
+		Overlay string  `json:"overlay"`
+		Type    string  `json:"type"`
+		Name    string  `json:"name"`
+		Force   string  `json:"force"`
+		X       float64 `json:"x"`
+		Y       float64 `json:"y"`
+		Label   string  `json:"label"`
+	}
+
+	type entities struct {
+		Name     string   `json:"name"`
+		Dir      string   `json:"dir"`
+		Entities []entity `json:"entities"`
+	}
+
+	var dump struct {
+		Surfaces []entities `json:"surfaces"`
+	}
+
+	for _, p := range surfaces {
+		var s = entities{Name: p.Name, Dir: p.Dir, Entities: []entity{}}
+		for _, c := range p.Chunks {
+			for i, overlay := range overlays {
+				var e = overlayEntities[overlay]
+				var label = e[2]
+				if strings.Contains(label, "%d") {
+					label = fmt.Sprintf(label, c.X, c.Y)
+				}
+
+				s.Entities = append(s.Entities, entity{
+					Overlay: overlay,
+					Type:    e[0],
+					Name:    e[1],
+					Force:   "player",
+					X:       float64(c.X*32+4+i*5) + 0.5,
+					Y:       float64(c.Y*32+16) + 0.5,
+					Label:   label,
+				})
+			}
+		}
+
+		dump.Surfaces = append(dump.Surfaces, s)
+	}
+
+	var data, err = json.Marshal(dump)
+	if err != nil {
+		return err
+	}
+
+	return writeFile(filepath.Join(so, "maptorio", "entities.json"), data)
+}
+
+// search writes what the mod would for the viewer's search box: a train stop
+// in every chunk with a screenshot, a map tag on the first one, and a player
+// on the first chunk of the first surface.
+func (g *game) search(so string, surfaces []surface) error {
+	type result struct {
+		Name string  `json:"name"`
+		Kind string  `json:"kind"`
+		X    float64 `json:"x"`
+		Y    float64 `json:"y"`
+	}
+
+	type results struct {
+		Name    string   `json:"name"`
+		Dir     string   `json:"dir"`
+		Results []result `json:"results"`
+	}
+
+	var dump struct {
+		Surfaces []results `json:"surfaces"`
+	}
+
+	for i, p := range surfaces {
+		var s = results{Name: p.Name, Dir: p.Dir, Results: []result{}}
+		for j, c := range p.Chunks {
+			var x, y = float64(c.X*32+4) + 0.5, float64(c.Y*32+16) + 0.5
+			s.Results = append(s.Results, result{fmt.Sprintf("Stop %dx%d", c.X, c.Y), "train-stop", x, y})
+
+			if j == 0 {
+				s.Results = append(s.Results, result{"Home " + p.Name, "tag", x + 8, y})
+			}
+
+			if i == 0 && j == 0 {
+				s.Results = append(s.Results, result{"engineer", "player", x + 12, y})
+			}
+		}
+
+		dump.Surfaces = append(dump.Surfaces, s)
+	}
+
+	var data, err = json.Marshal(dump)
+	if err != nil {
+		return err
+	}
+
+	return writeFile(filepath.Join(so, "maptorio", "search.json"), data)
+}
+
+// screenshot makes a size x size image for the chunk at x, y, in a checkerboard
+// so neighbouring chunks can be told apart.
+func screenshot(x, y, size int, ext string) []byte {
+	var c = color.RGBA{0x3c, 0x5a, 0x3c, 0xff}
+	if (x+y)%2 == 0 {
+		c = color.RGBA{0x5a, 0x4a, 0x32, 0xff}
+	}
+
+	var im = image.NewRGBA(image.Rect(0, 0, size, size))
+	for i := 0; i < len(im.Pix); i += 4 {
+		im.Pix[i], im.Pix[i+1], im.Pix[i+2], im.Pix[i+3] = c.R, c.G, c.B, c.A
+	}
+
+	var buf = new(bytes.Buffer)
+	if ext == "png" {
+		png.Encode(buf, im)
+	} else {
+		jpeg.Encode(buf, im, nil)
+	}
+
+	return buf.Bytes()
+}
+
+// writeData reads the write-data path out of the config.ini at path.
+func writeData(path string) (string, error) {
+	var f, err = os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+
+	var scanner = bufio.NewScanner(f)
+	for scanner.Scan() {
+		var line = strings.TrimSpace(scanner.Text())
+		if strings.HasPrefix(line, "write-data=") {
+			return strings.TrimPrefix(line, "write-data="), nil
+		}
+	}
+
+	return "", fmt.Errorf("no write-data in %s", path)
+}
+
+// createSave writes a save with a header made by version and nothing else.
+func createSave(path, version string) error {
+	var v [4]uint16
+	for i, part := range strings.Split(version, ".") {
+		var n, err = strconv.Atoi(part)
+		if err != nil || i > 2 {
+			return fmt.Errorf("invalid FAKE_FACTORIO_VERSION %s", version)
+		}
+
+		v[i] = uint16(n)
+	}
+
+	var str = func(b *bytes.Buffer, s string) {
+		b.WriteByte(byte(len(s)))
+		b.WriteString(s)
+	}
+
+	// The header changed a little in 0.16 and 0.17, see readSaveHeader in maptorio
+	var since = func(major, minor uint16) bool {
+		return v[0] > major || (v[0] == major && v[1] >= minor)
+	}
+
+	var h = new(bytes.Buffer)
+	binary.Write(h, binary.LittleEndian, v)
+	if since(0, 17) {
+		h.WriteByte(0)
+	}
+
+	str(h, "")
+	str(h, "freeplay")
+	str(h, "base")
+	h.Write([]byte{0, 0, 0}) // difficulty, finished, player won
+	str(h, "")
+	h.Write([]byte{0, 0, 0}) // can continue, finished but continuing, saving replay
+	if since(0, 16) {
+		h.WriteByte(0) // allow non-admin debug options
+	}
+
+	h.Write([]byte{byte(v[0]), byte(v[1]), byte(v[2])})
+	binary.Write(h, binary.LittleEndian, uint16(1))
+	h.WriteByte(1) // allowed commands
+	h.WriteByte(1) // one mod, base
+	str(h, "base")
+	h.Write([]byte{byte(v[0]), byte(v[1]), byte(v[2])})
+	binary.Write(h, binary.LittleEndian, uint32(0))
+
+	var out, err = os.Create(path)
+	if err != nil {
+		return err
+	}
+
+	var z = zip.NewWriter(out)
+	var name = strings.TrimSuffix(filepath.Base(path), filepath.Ext(path))
+
+	var w, zerr = z.Create(name + "/level.dat")
+	if zerr == nil {
+		_, zerr = w.Write(h.Bytes())
+	}
+
+	if err = z.Close(); zerr == nil {
+		zerr = err
+	}
+
+	if err = out.Close(); zerr == nil {
+		zerr = err
+	}
+
+	return zerr
+}
+
+// saveVersion reads the version out of the header of the save at path.
+func saveVersion(path string) (string, error) {
+	var z, err = zip.OpenReader(path)
+	if err != nil {
+		return "", err
+	}
+	defer z.Close()
+
+	for _, f := range z.File {
+		if filepath.Base(f.Name) != "level.dat" && filepath.Base(f.Name) != "level-init.dat" {
+			continue
+		}
+
+		var rc, err = f.Open()
+		if err != nil {
+			return "", err
+		}
+		defer rc.Close()
+
+		var v [4]uint16
+		if err = binary.Read(rc, binary.LittleEndian, &v); err != nil {
+			return "", err
+		}
+
+		return fmt.Sprintf("%d.%d.%d", v[0], v[1], v[2]), nil
+	}
+
+	return "", fmt.Errorf("%s has no level data", path)
+}
+
+func compareVersions(a, b string) int {
+	var as, bs = strings.Split(a, "."), strings.Split(b, ".")
+	for i := 0; i < len(as) && i < len(bs); i++ {
+		var x, _ = strconv.Atoi(as[i])
+		var y, _ = strconv.Atoi(bs[i])
+		if x != y {
+			if x < y {
+				return -1
+			}
+			return 1
+		}
+	}
+
+	return 0
+}
+
+// writeFile writes data to path, making its directory first.
+func writeFile(path string, data []byte) error {
+	if err := os.MkdirAll(filepath.Dir(path), os.ModePerm); err != nil {
+		return err
+	}
+
+	return ioutil.WriteFile(path, data, 0644)
+}
+
+// logf writes a line to factorio-current.log the way the game does, with the
+// seconds since it started in front.
+func (g *game) logf(format string, args ...interface{}) {
+	if g.log != nil {
+		fmt.Fprintf(g.log, "%8.3f %s\n", time.Since(g.start).Seconds(), fmt.Sprintf(format, args...))
+	}
+}
+
+func env(name, def string) string {
+	if v := os.Getenv(name); v != "" {
+		return v
+	}
+
+	return def
+}
+
+func fatal(err error) {
+	fmt.Fprintln(os.Stderr, err)
+	os.Exit(1)
+}
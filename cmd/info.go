@@ -0,0 +1,45 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"text/tabwriter"
+
+	"github.com/avidal/maptorio"
+)
+
+// info prints what the header of the save at path says about it.
+func info(path string) {
+	if err := printInfo(os.Stdout, path); err != nil {
+		log.Fatal(err)
+	}
+}
+
+// printInfo writes what the header of the save at path says about it to w.
+func printInfo(w io.Writer, path string) error {
+	var h, err = maptorio.ReadSaveHeader(path)
+	if err != nil {
+		return err
+	}
+
+	var scenario = h.Level
+	if h.Campaign != "" {
+		scenario = h.Campaign + "/" + h.Level
+	}
+
+	fmt.Fprintf(w, "Save:      %s\n", path)
+	fmt.Fprintf(w, "Version:   %s (build %d)\n", h.Version, h.Version[3])
+	fmt.Fprintf(w, "Scenario:  %s\n", scenario)
+	fmt.Fprintf(w, "Base mod:  %s\n", h.BaseMod)
+	fmt.Fprintf(w, "Mods:      %d\n\n", len(h.Mods))
+
+	var tw = tabwriter.NewWriter(w, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(tw, "  MOD\tVERSION\tCRC")
+	for _, m := range h.Mods {
+		fmt.Fprintf(tw, "  %s\t%s\t%08x\n", m.Name, m.Version, m.CRC)
+	}
+
+	return tw.Flush()
+}
@@ -0,0 +1,40 @@
+package main
+
+import (
+	"bytes"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestPrintInfo(t *testing.T) {
+	var save = fixtureSave(t, "2.0.60")
+
+	var out bytes.Buffer
+	var err = printInfo(&out, save)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var want = "Save:      " + save + `
+Version:   2.0.60 (build 62000)
+Scenario:  freeplay
+Base mod:  base
+Mods:      5
+
+  MOD             VERSION  CRC
+  base            2.0.60   2a7d44c1
+  elevated-rails  2.0.60   3b9e0a72
+  quality         2.0.60   c05e1f38
+  space-age       2.0.60   71d4b6e9
+  Bottleneck      0.12.1   9e3c5a07
+`
+
+	if out.String() != want {
+		t.Errorf("got:\n%s\nwant:\n%s", out.String(), want)
+	}
+
+	if err = printInfo(&out, filepath.Join(t.TempDir(), "missing.zip")); err == nil || !strings.Contains(err.Error(), "missing.zip") {
+		t.Errorf("got %v for a missing save", err)
+	}
+}
@@ -1,16 +1,20 @@
 package main // import "code.heyviddy.com/maptorio/cmd"
 
 import (
+	"context"
 	"fmt"
-	"html/template"
 	"io"
 	"io/ioutil"
 	"log"
+	"math"
 	"os"
 	"os/exec"
+	"os/signal"
 	"path/filepath"
 	"strconv"
 	"strings"
+	"syscall"
+	"text/template"
 	"time"
 
 	"github.com/avidal/maptorio"
@@ -22,14 +26,40 @@ type iniconfig struct {
 	ConfigPath string
 	Binary     string `ini:"binary-path"`
 
-	Resolution     int  `ini:"screenshot-resolution"`
-	GrowChunks     int  `ini:"grow-chunks"`
+	Resolution int `ini:"screenshot-resolution"`
+	GrowChunks int `ini:"grow-chunks"`
+	FillHoles  int `ini:"fill-holes"`
+
+	Forces             string `ini:"forces"`
+	IncludeEntityTypes string `ini:"include-entity-types"`
+	ExcludeEntityTypes string `ini:"exclude-entity-types"`
+
 	ShowEntityInfo bool `ini:"show-entity-info"`
 	TimeOfDay      int  `ini:"time-of-day"`
 
+	TileFormat  string `ini:"tile-format"`
+	TileQuality int    `ini:"tile-quality"`
+	TileArchive string `ini:"tile-archive"`
+
 	OutputDirectory    string `ini:"output-directory"`
 	TemporaryDirectory string `ini:"temporary-directory"`
+	StallTimeout       int    `ini:"stall-timeout"`
+	LoadTimeout        int    `ini:"load-timeout"`
+	ScreenshotTimeout  int    `ini:"screenshot-timeout"`
+	RenderTimeout      int    `ini:"render-timeout"`
+
+	ModDirectory string `ini:"mod-directory"`
+	EnabledMods  string `ini:"enabled-mods"`
+
+	// Region is the part of the map to render, see selectRegion
+	Region string `ini:"region"`
 
+	Overlays string `ini:"overlays"`
+
+	format      maptorio.Format
+	mods        []string
+	regions     map[string]string
+	region      *region
 	initialized bool
 }
 
@@ -54,21 +84,36 @@ func (c *iniconfig) Set(path string) error {
 		return err
 	}
 
+	// These are what the map looked like before they could be configured
+	c.ShowEntityInfo = true
+	c.TimeOfDay = 12
+	c.StallTimeout = 300
+	c.Overlays = strings.Join(overlayNames, ", ")
+
+	// Filling holes is on unless it's turned off, as the example config has it
+	c.FillHoles = 16
+
 	if err = cfg.MapTo(c); err != nil {
 		return err
 	}
 
-	if stat, err := os.Stat(c.Binary); err != nil {
-		return err
-	} else if stat.IsDir() {
-		return fmt.Errorf("invalid binary path '%s'", c.Binary)
-	}
+	// Named regions are checked when one's used, so a typo in one doesn't stop the others working
+	c.regions = cfg.Section("regions").KeysHash()
 
-	if c.OutputDirectory, err = filepath.Abs(c.OutputDirectory); err != nil {
-		return err
+	// Without a binary path render looks for the game itself
+	if c.Binary != "" {
+		if stat, err := os.Stat(c.Binary); err != nil {
+			return err
+		} else if stat.IsDir() {
+			return fmt.Errorf("invalid binary path '%s'", c.Binary)
+		}
+
+		if c.Binary, err = filepath.Abs(c.Binary); err != nil {
+			return err
+		}
 	}
 
-	if c.Binary, err = filepath.Abs(c.Binary); err != nil {
+	if c.OutputDirectory, err = filepath.Abs(c.OutputDirectory); err != nil {
 		return err
 	}
 
@@ -79,31 +124,101 @@ func (c *iniconfig) Set(path string) error {
 		}
 	}
 
+	// Mods are read from the game's own mod directory unless they say otherwise
+	if c.ModDirectory == "" {
+		c.ModDirectory = defaultModDirectory()
+	}
+
+	if c.ModDirectory, err = filepath.Abs(c.ModDirectory); err != nil {
+		return err
+	}
+
+	if c.mods = parseList(c.EnabledMods); len(c.mods) > 0 {
+		if stat, err := os.Stat(c.ModDirectory); err != nil {
+			return err
+		} else if !stat.IsDir() {
+			return fmt.Errorf("invalid mod-directory '%s'", c.ModDirectory)
+		}
+	}
+
 	if c.Resolution != 512 && c.Resolution != 1024 && c.Resolution != 2048 && c.Resolution != 4096 {
 		return fmt.Errorf("invalid screenshot-resolution %d", c.Resolution)
 	}
 
+	if c.TileQuality < 0 || c.TileQuality > 100 {
+		return fmt.Errorf("invalid tile-quality %d, must be between 1 and 100", c.TileQuality)
+	}
+
+	if c.TileFormat == "" {
+		c.TileFormat = "jpeg"
+	}
+
+	if c.format, err = maptorio.ParseFormat(c.TileFormat, c.TileQuality); err != nil {
+		return err
+	}
+
+	if c.TileArchive != "" && c.TileArchive != "mbtiles" && c.TileArchive != "pmtiles" {
+		return fmt.Errorf("invalid tile-archive %s", c.TileArchive)
+	}
+
 	if c.GrowChunks < 0 {
 		return fmt.Errorf("invalid grow-chunks %d, must be greater than or equal to 0", c.GrowChunks)
 	}
 
+	if c.FillHoles < 0 {
+		return fmt.Errorf("invalid fill-holes %d, must be greater than or equal to 0", c.FillHoles)
+	}
+
+	if c.StallTimeout <= 0 {
+		return fmt.Errorf("invalid stall-timeout %d, must be greater than 0", c.StallTimeout)
+	}
+
+	if c.LoadTimeout < 0 || c.ScreenshotTimeout < 0 || c.RenderTimeout < 0 {
+		return fmt.Errorf("invalid timeout, load-timeout, screenshot-timeout and render-timeout must be greater than or equal to 0")
+	}
+
 	if c.TimeOfDay < 0 || c.TimeOfDay > 23 {
 		return fmt.Errorf("invalid time-of-day %d, must be between 0 and 23", c.TimeOfDay)
 	}
 
+	for _, overlay := range parseOverlays(c.Overlays) {
+		if !contains(overlayNames, overlay) {
+			return fmt.Errorf("invalid overlay '%s', must be none or some of %s", overlay, strings.Join(overlayNames, ", "))
+		}
+	}
+
 	return nil
 
 }
 
+// baseZoom returns the zoom level the screenshots become the tiles for. That's
+// 10 for 1024 pixel screenshots, and one more or less for every doubling or
+// halving of the resolution, so one map unit is always one chunk.
+func (c *iniconfig) baseZoom() int {
+	return 10 + int(math.Log2(float64(c.Resolution)/1024))
+}
+
 func main() {
 
 	// Setup the config from ini as a global flag
 	var config iniconfig
 	var flags = pflag.NewFlagSet("", pflag.ExitOnError)
 	flags.VarP(&config, "config", "c", "Config file to use")
+	var resume = flags.Bool("resume", false, "Keep the map tiles an interrupted mapgen already built, to finish it")
+	var addr = flags.String("addr", "localhost:8080", "Address to listen on for serve")
+	var regionSpec = flags.String("region", "", "Only render this region of the map: x1,y1,x2,y2 in the world, chunk:x1,y1,x2,y2 in chunks, or a name from [regions] in the config")
 	flags.Usage = func() {
-		fmt.Println(`
+		fmt.Print(`
 USAGE: maptorio -c <config file> [command] [savefile]
+
+COMMANDS:
+  render <savefile>     render the screenshots for a save
+  mapgen <output dir>   generate the map from rendered screenshots
+  serve <map>           serve a map directory, or mbtiles or pmtiles archive, over HTTP
+  info <savefile>       print the version, scenario and mods of a save
+
+With no command, render and then generate the map for savefile.
+
 `)
 		flags.PrintDefaults()
 	}
@@ -111,6 +226,34 @@ USAGE: maptorio -c <config file> [command] [savefile]
 	// Ignoring the error here since we have pflag.ExitOnError set
 	_ = flags.Parse(os.Args[1:])
 
+	// Cancel whatever we're doing on Ctrl-C or a terminate so we can stop cleanly
+	var ctx, stop = signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	// Serving a map that's already generated doesn't need any configuration
+	if flags.Arg(0) == "serve" {
+		if flags.NArg() < 2 {
+			fmt.Println("Error: missing map to serve")
+			flags.Usage()
+			os.Exit(2)
+		}
+
+		serve(ctx, flags.Arg(1), *addr)
+		return
+	}
+
+	// Neither does looking inside a save
+	if flags.Arg(0) == "info" {
+		if flags.NArg() < 2 {
+			fmt.Println("Error: missing save file")
+			flags.Usage()
+			os.Exit(2)
+		}
+
+		info(flags.Arg(1))
+		return
+	}
+
 	// Make sure they supplied a value for the config file
 	if !config.initialized {
 		fmt.Println("Error: no configuration file set")
@@ -124,23 +267,31 @@ USAGE: maptorio -c <config file> [command] [savefile]
 		os.Exit(2)
 	}
 
+	// mapgen builds whatever region the map was rendered for, so the region
+	// setting is only read when rendering
+	if flags.Arg(0) != "mapgen" {
+		if err := config.selectRegion(*regionSpec); err != nil {
+			log.Fatal(err)
+		}
+	}
+
 	switch flags.Arg(0) {
 	case "render":
-		render(config, flags.Arg(1))
+		render(ctx, config, flags.Arg(1))
 	case "mapgen":
 		// If they explicitly want to generate the map, that requires setting the output directory
 		// as the first argument
 		config.OutputDirectory = flags.Arg(1)
-		mapgen(config)
+		mapgen(ctx, config, *resume)
 	default:
 		// The default process is to first render the screenshots (which updates the config)
 		// and then generate the map
-		config = render(config, flags.Arg(0))
-		mapgen(config)
+		config = render(ctx, config, flags.Arg(0))
+		mapgen(ctx, config, *resume)
 	}
 }
 
-func render(config iniconfig, save string) iniconfig {
+func render(ctx context.Context, config iniconfig, save string) iniconfig {
 	var err error
 	if save, err = filepath.Abs(save); err != nil {
 		fmt.Printf("invalid save file %s; got: %s\n", save, err.Error())
@@ -158,6 +309,27 @@ func render(config iniconfig, save string) iniconfig {
 		os.Exit(2)
 	}
 
+	// Find out which version made the save before starting the game, since an older
+	// game can't load it
+	var header, herr = maptorio.ReadSaveHeader(save)
+	if herr != nil {
+		fmt.Printf("invalid save file %s; got: %s\n", save, herr.Error())
+		os.Exit(2)
+	}
+
+	fmt.Printf("Save %s was made with factorio %s\n", filepath.Base(save), header.Version)
+
+	if config.Binary == "" {
+		var v maptorio.Version
+		if config.Binary, v, err = defaultLocator().findBinary(header.Version); err != nil {
+			log.Fatal(err)
+		}
+
+		fmt.Printf("Found factorio %s at %s\n", v, config.Binary)
+	} else if err := checkVersion(config.Binary, header.Version); err != nil {
+		log.Fatal(err)
+	}
+
 	config = prepareWorkspace(config, save)
 
 	fmt.Printf("Rendering with save %s\n", save)
@@ -173,92 +345,102 @@ func render(config iniconfig, save string) iniconfig {
 
 	fmt.Println("Running factorio with args ", cmdargs)
 
-	var cmd = exec.Command(config.Binary, cmdargs...)
+	var cmd *exec.Cmd
+	if cmd, err = gameCommand(config.Binary, config.TemporaryDirectory, cmdargs...); err != nil {
+		log.Fatal(err)
+	}
+
+	if isSteamInstall(config.Binary) {
+		fmt.Println("Launching the Steam version directly, without the Steam client")
+	}
 
-	if err := cmd.Start(); err != nil {
+	// Start watching for the mod's output before the game starts so nothing is missed
+	var so = filepath.Join(config.TemporaryDirectory, "data", "script-output")
+	var watch *progress
+	if watch, err = watchProgress(so); err != nil {
 		log.Fatal(err)
 	}
 
-	fmt.Println("Waiting for screenshots to render...")
+	// The whole render gets render-timeout, on top of the limits for each part of it
+	var rctx = ctx
+	if config.RenderTimeout > 0 {
+		var cancel context.CancelFunc
+		rctx, cancel = context.WithTimeout(ctx, time.Duration(config.RenderTimeout)*time.Second)
+		defer cancel()
+	}
 
-	// After it starts we want to check for a rendered-tiles file in the script output. Once it writes we know
-	// how many images to look for and once every one of them has rendered we can kill the process
-	var sig = make(chan error, 1)
-	go func() {
-		// Before we start, wait for 15s for the game to even start
-		<-time.After(15 * time.Second)
+	var limits = timeouts{
+		Stall:       time.Duration(config.StallTimeout) * time.Second,
+		Load:        time.Duration(config.LoadTimeout) * time.Second,
+		Screenshots: time.Duration(config.ScreenshotTimeout) * time.Second,
+	}
 
-		var so = filepath.Join(config.TemporaryDirectory, "data", "script-output")
-		var expected int
-		for {
-			var output []byte
-			var err error
-			if output, err = ioutil.ReadFile(filepath.Join(so, "rendered-tiles")); err != nil {
-				fmt.Printf("Got error reading output file %s\n", err.Error())
-				<-time.After(1 * time.Second)
-				continue
-			}
+	var logs = newGameLogs(config.TemporaryDirectory)
+	err = supervise(rctx, cmd, watch, limits, logs)
+	if ctx.Err() != nil {
+		fmt.Println("Interrupted, stopped factorio.")
+		os.Exit(130)
+	}
 
-			fmt.Printf("Expecting to find %s tiles.\n", string(output))
+	if err == context.DeadlineExceeded {
+		err = diagnosed(fmt.Errorf("the render took longer than render-timeout, %ds", config.RenderTimeout), logs)
+	}
 
-			if expected, err = strconv.Atoi(string(output)); err != nil {
-				sig <- err
-			}
+	if err != nil {
+		log.Fatal(err)
+	}
 
-			// Break out of this loop since we know how many tiles we're supposed to have
-			break
+	// Now that the initial tile generation phase is complete, copy all of those tiles to the output directory
+	// so the rest of the rendering can continue. If the game couldn't write them in the format we want
+	// they're converted along the way.
+	var shot = screenshotFormat(config.format)
+	var surfaces = watch.manifest.surfaces()
+	for _, s := range surfaces {
+		var src = filepath.Join(so, "tiles", s.Dir)
+		var dst = filepath.Join(config.OutputDirectory, "tiles", s.Dir)
+
+		if _, err := os.Stat(src); os.IsNotExist(err) {
+			// Nothing on this surface was worth a screenshot
+			continue
 		}
 
-		// Now we know how many we *should* have, so let's loop until we have that many files
-		for {
-			var files []string
-			if files, err = filepath.Glob(filepath.Join(so, "tiles", "10") + "/*"); err != nil {
-				sig <- err
+		if shot == config.format {
+			if err := copyDir(src, dst); err != nil {
+				log.Fatal(err)
 			}
 
-			if len(files) >= expected {
-				fmt.Println("Found the expected number of tiles. Exiting game.")
-				break
-			}
+			continue
+		}
 
-			fmt.Printf("Found %d of %d tiles, waiting for more...\n", len(files), expected)
-			<-time.After(1 * time.Second)
+		fmt.Printf("Converting screenshots of %s from %s to %s\n", s.Name, shot.Ext(), config.format.Ext())
+		if err := maptorio.Transcode(ctx, maptorio.NewDirStore(src, shot.Ext()), maptorio.NewDirStore(dst, config.format.Ext()), config.baseZoom(), shot, config.format); err != nil {
+			log.Fatal(err)
 		}
-		sig <- nil
-	}()
+	}
 
-	// The goroutine will send a signal over the sig channel when it has encountered various conditions, the error
-	// will be nil if everything was successful. The primary issue is that if the game itself crashes for some reason
-	// the worker will continue forever. So, we need to be aware of what it's doing and track its own lifecycle.
-	// Namely, if the game quits before we receive a signal we can stop the process and report the problem, but otherwise
-	// we want to wait until we receive a signal, then issue the stop.
-	var pchan = make(chan error, 1)
-	go func() {
-		pchan <- cmd.Wait()
-	}()
+	// Keep track of which surfaces there are, and what they're called, for mapgen and the viewer
+	if err := writeSurfaces(config.OutputDirectory, surfaces); err != nil {
+		log.Fatal(err)
+	}
 
-	select {
-	case err = <-pchan:
-		// NOTE: The user closing the game will cause the error to be nil. We still report this as an
-		// abnormal exit because they shouldn't do that.
-		log.Fatalf("Factorio exited abnormally. Got: %v\n", err)
-	case err = <-sig:
-		fmt.Printf("Got signal %v\n", err)
-		cmd.Process.Kill()
+	// The viewer centers itself on the region, if there was one
+	if err := writeRegion(config.OutputDirectory, config.region); err != nil {
+		log.Fatal(err)
 	}
 
-	// Now that the initial tile generation phase is complete, copy all of those tiles to the output directory
-	// so the rest of the rendering can continue
-	var sourceTiles = filepath.Join(config.TemporaryDirectory, "data", "script-output", "tiles")
-	var destTiles = filepath.Join(config.OutputDirectory, "tiles")
-	if err := copyDir(sourceTiles, destTiles); err != nil {
+	// The viewer's overlays and search box
+	if err := writeEntities(so, config.OutputDirectory); err != nil {
+		log.Fatal(err)
+	}
+
+	if err := writeSearch(so, config.OutputDirectory); err != nil {
 		log.Fatal(err)
 	}
 
 	return config
 }
 
-func mapgen(config iniconfig) {
+func mapgen(ctx context.Context, config iniconfig, resume bool) {
 	var od = config.OutputDirectory
 	fmt.Printf("Making layers using output directory %s\n", od)
 
@@ -266,11 +448,111 @@ func mapgen(config iniconfig) {
 	// use as filler
 	copyFile("empty.jpg", filepath.Join(od, "empty.jpg"))
 
-	maptorio.Render(od)
+	var surfaces, err = readSurfaces(od)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	if len(surfaces) == 0 {
+		log.Fatalf("No surfaces found in %s", od)
+	}
+
+	// Each surface is a map of its own. One failing doesn't stop the rest from
+	// being built, they're all reported once the index is in place
+	var failed []error
+	for _, s := range surfaces {
+		fmt.Printf("Making layers for %s\n", s.Name)
+
+		if err = mapgenSurface(ctx, config, od, s, resume); ctx.Err() != nil {
+			fmt.Printf("Interrupted, run mapgen --resume on %s to finish the map.\n", od)
+			os.Exit(130)
+		}
+
+		if err != nil {
+			failed = append(failed, fmt.Errorf("%s: %s", s.Name, err))
+		}
+	}
+
+	var r *region
+	if r, err = readRegion(od); err != nil {
+		log.Fatal(err)
+	}
 
 	// After the rendering pass has completed, generate the index file
-	copyFile("index.html", filepath.Join(od, "index.html"))
+	if err = writeViewer(config, surfaces, r, filepath.Join(od, "index.html")); err != nil {
+		log.Fatal(err)
+	}
+
+	if len(failed) > 0 {
+		for _, err = range failed {
+			log.Println(err)
+		}
+
+		os.Exit(1)
+	}
+}
+
+// tileConcurrency is how many tiles of res pixels are built at once. Every
+// tile in flight holds its four source tiles and the grid they're drawn into,
+// so the 48 at a time used for 1024px tiles is scaled down for bigger ones to
+// keep memory use about the same.
+func tileConcurrency(res int) int {
+	var n = 48 * 1024 * 1024 / (res * res)
+	if n < 1 {
+		return 1
+	} else if n > 48 {
+		return 48
+	}
+
+	return n
+}
+
+// mapgenSurface builds the zoom levels for one surface of the map in od.
+func mapgenSurface(ctx context.Context, config iniconfig, od string, s surface, resume bool) error {
+	// Skip over any tiles that fail so one bad screenshot doesn't throw away
+	// the rest of the map; they're all reported once the index is in place.
+	// The manifest lets a later render of the same save only rebuild the parts
+	// of the map that changed.
+	var opts = []maptorio.Option{
+		maptorio.WithZoomRange(0, config.baseZoom()),
+		maptorio.WithTileSize(config.Resolution),
+		maptorio.WithConcurrency(tileConcurrency(config.Resolution)),
+		maptorio.WithFormat(config.format),
+		maptorio.WithErrorPolicy(maptorio.SkipOnError),
+		maptorio.WithManifest(filepath.Join(od, "manifests", s.Dir+".json")),
+		maptorio.WithResume(resume),
+		maptorio.WithOutput(os.Stdout),
+	}
+
+	// When writing an archive the whole pyramid is built inside an mbtiles one
+	var archive *maptorio.MBTilesStore
+	if config.TileArchive != "" {
+		var err error
+		if archive, err = openArchive(ctx, config, od, s); err != nil {
+			return err
+		}
+
+		opts = append(opts, maptorio.WithStore(archive))
+	} else {
+		opts = append(opts, maptorio.WithStore(maptorio.NewDirStore(filepath.Join(od, "tiles", s.Dir), config.format.Ext())))
+	}
+
+	var err = maptorio.Render(ctx, od, opts...)
+	if ctx.Err() != nil {
+		if archive != nil {
+			archive.Close()
+		}
 
+		return ctx.Err()
+	}
+
+	if archive != nil {
+		if cerr := closeArchive(archive, config, od, s); cerr != nil {
+			return cerr
+		}
+	}
+
+	return err
 }
 
 // prepareWorkspace makes the proper fs layout for running the game and rendering the screenshots
@@ -291,9 +573,25 @@ func prepareWorkspace(c iniconfig, save string) iniconfig {
 	savename = strings.TrimSuffix(savename, filepath.Ext(savename))
 	var od = filepath.Join(c.OutputDirectory, fmt.Sprintf("maptorio-%s", savename))
 
-	// Remove the current output directory if it exists
-	if err := os.RemoveAll(od); err != nil {
-		log.Fatal(err)
+	// A region is a map of its own, so it doesn't replace the whole map's tiles. A named one can be
+	// rendered again over itself
+	if c.region != nil {
+		od += "-" + c.region.dir()
+		if c.region.Name != "" {
+			fmt.Printf("Rendering region %s, %s\n", c.region.Name, c.region.box())
+		} else {
+			fmt.Printf("Rendering region %s\n", c.region.box())
+		}
+	}
+
+	// Keep the rest of the existing map so mapgen only has to rebuild what
+	// changed, but clear out the old screenshots since the game renders a fresh
+	// set every time
+	var screenshots, _ = filepath.Glob(filepath.Join(od, "tiles", "*", strconv.Itoa(c.baseZoom())))
+	for _, dir := range screenshots {
+		if err := os.RemoveAll(dir); err != nil {
+			log.Fatal(err)
+		}
 	}
 
 	if err := os.MkdirAll(od, os.ModePerm); err != nil {
@@ -360,103 +658,11 @@ skip-vram-detection=true
 		log.Fatal(err)
 	}
 
-	var modControl = `
--- maptorio-control.lua
-
-local ticks = 0
-script.on_init(function()
-    script.on_event(defines.events.on_tick, function()
-        ticks = ticks + 1
-        -- wait one tick before starting to avoid crashing!
-        if ticks == 1 then
-            generate()
-        end
-    end)
-end)
-
-function generate()
-    -- When the game is initialized, take screenshots
-    -- The screenshots are taken per-chunk at 1024x1024 at zoom 1, which means each screenshot will cover exactly 32x32 game tiles.
-
-    local player = game.players[1]
-    local surface = player.surface
-    surface.always_day = true
-    local force = player.force
-
-    -- First, determine the boundaries of the entire map
-    local topleft = { x=0, y=0 }
-    local bottomright = { x=0, y=0 }
-
-    local total_chunks = 0
-    for chunk in surface.get_chunks() do
-        if surface.is_chunk_generated(chunk) then
-            topleft.x = math.min(topleft.x, chunk.x)
-            topleft.y = math.min(topleft.y, chunk.y)
-            bottomright.x = math.max(bottomright.x, chunk.x)
-            bottomright.y = math.max(bottomright.y, chunk.y)
-            total_chunks = total_chunks + 1
-        end
-    end
-
-    local log = {}
-    table.insert(log, "chunks=" .. total_chunks .. "; topleft=" .. topleft.x .. "x" .. topleft.y .. "; bottomright=" .. bottomright.x .. "x" .. bottomright.y)
-
-    -- Now, topleft and bottomright contain *chunk* positions, not actual *positions*, which are game tiles
-    -- This means that we will need to multiply chunk coordinates by 32 to get the origin position
-    -- But because chunk coordinates are the center-most tile, subtract 16 to get the true topleft
-    -- And we can iterate from top to bottom with one chunk of padding to make sure we get all of them.
-
-    -- this counter catches the actual number of chunks that will be rendered, as opposed to total_chunks, which is the
-    -- complete number of generated chunks
-    local i = 0
-    for x = topleft.x-1, bottomright.x+1, 1 do
-        for y = topleft.y-1, bottomright.y+1, 1 do
-            local items = 0
-            local generated = surface.is_chunk_generated({x, y})
-
-            if not generated then
-                table.insert(log, "--> not generated, skipping.")
-            else
-                -- if this chunk has a nearby chunk with any items in it, we'll render it
-                local check_area = {
-                    top_left = { x = (x - 1) * 32 - 16, y = (y - 1) * 32 - 16},
-                    bottom_right= { x = (x + 1) * 32 + 16, y = (y + 1) * 32 + 16},
-                }
-                items = surface.count_entities_filtered({
-                    area=check_area,
-                    force="player",
-                    limit=1 -- no need to keep searching; we either find something or we don't
-                })
-            end
-
-            table.insert(log, "chunk=" .. x .. "x" .. y .. "y" .. "; has " .. items .. " items.")
-
-            local position = { x = x * 32 - 16, y = y * 32 - 16 }
-            table.insert(log, "--> position=" .. position.x .. "x" .. position.y)
-
-            if items == 0 then
-                table.insert(log, "--> no items, skipping.")
-            end
-
-            if items > 0 and generated then
-                i = i + 1
-
-                game.take_screenshot({
-                    show_entity_info=true,
-                    position=position,
-                    resolution={1024,1024},
-                    zoom=1,
-                    path="tiles/10/" .. x .. "x" .. y .. ".jpg"
-                })
-            end
-        end
-    end
-
-    game.write_file("log", table.concat(log, "\n"))
-    game.write_file("rendered-tiles", i)
-end
-`
-	if err := ioutil.WriteFile(filepath.Join(td, "mods", "maptorio_0.0.0", "control.lua"), []byte(modControl), os.ModePerm); err != nil {
+	if err = writeControl(filepath.Join(td, "mods", "maptorio_0.0.0", "control.lua"), c); err != nil {
+		log.Fatal(err)
+	}
+
+	if err = installMods(c, save, filepath.Join(td, "mods")); err != nil {
 		log.Fatal(err)
 	}
 
@@ -468,6 +674,17 @@ end
 	return c
 }
 
+// screenshotFormat returns the format the game should write its screenshots in
+// for tiles in the format f. The game can't write WebP, so those are taken as
+// lossless PNG and converted afterwards.
+func screenshotFormat(f maptorio.Format) maptorio.Format {
+	if f == maptorio.WebP {
+		return maptorio.PNG
+	}
+
+	return f
+}
+
 // copyFile copies the contents of the file named src to the file named
 // by dst. The file will be created if it does not already exist. If the
 // destination file exists, all it's contents will be replaced by the contents
@@ -0,0 +1,340 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"runtime"
+	"sort"
+	"strings"
+	"text/tabwriter"
+
+	"github.com/avidal/maptorio"
+)
+
+// mod is a single mod in a mod directory, either a zip file or an unpacked
+// directory.
+type mod struct {
+	Name    string
+	Version maptorio.Version
+	Path    string
+}
+
+// defaultModDirectory returns the mods directory inside the game's user data
+// directory for this platform.
+func defaultModDirectory() string {
+	var home, _ = os.UserHomeDir()
+
+	switch runtime.GOOS {
+	case "windows":
+		return filepath.Join(os.Getenv("APPDATA"), "Factorio", "mods")
+	case "darwin":
+		return filepath.Join(home, "Library", "Application Support", "factorio", "mods")
+	default:
+		return filepath.Join(home, ".factorio", "mods")
+	}
+}
+
+// parseList splits a comma separated setting, like enabled-mods, into its items.
+func parseList(s string) []string {
+	var items []string
+	for _, item := range strings.Split(s, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			items = append(items, item)
+		}
+	}
+
+	return items
+}
+
+// findMods lists every version of each mod in dir by name, newest first.
+func findMods(dir string) (map[string][]mod, error) {
+	var entries, err = ioutil.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+
+	var mods = make(map[string][]mod)
+	for _, entry := range entries {
+		if m, ok := readMod(dir, entry); ok {
+			mods[m.Name] = append(mods[m.Name], m)
+		}
+	}
+
+	for _, versions := range mods {
+		sort.Slice(versions, func(i, j int) bool { return versions[i].Version.Compare(versions[j].Version) > 0 })
+	}
+
+	return mods, nil
+}
+
+// readMod works out which mod the directory entry fi is. The game names mods
+// {name}_{version}.zip, but an unpacked mod might leave the version off, in
+// which case it's read from the mod's info.json.
+func readMod(dir string, fi os.FileInfo) (mod, bool) {
+	var base = fi.Name()
+	if !fi.IsDir() {
+		if filepath.Ext(base) != ".zip" {
+			return mod{}, false
+		}
+
+		base = strings.TrimSuffix(base, ".zip")
+	}
+
+	var m = mod{Name: base, Path: filepath.Join(dir, fi.Name())}
+	if i := strings.LastIndex(base, "_"); i > 0 {
+		if v, err := maptorio.ParseVersion(base[i+1:]); err == nil {
+			m.Name, m.Version = base[:i], v
+			return m, true
+		}
+	}
+
+	if !fi.IsDir() {
+		return m, true
+	}
+
+	var info struct {
+		Name    string `json:"name"`
+		Version string `json:"version"`
+	}
+
+	var data, err = ioutil.ReadFile(filepath.Join(m.Path, "info.json"))
+	if err != nil || json.Unmarshal(data, &info) != nil {
+		return mod{}, false
+	}
+
+	if info.Name != "" {
+		m.Name = info.Name
+	}
+
+	// A version the game wouldn't accept either is left as 0.0.0
+	m.Version, _ = maptorio.ParseVersion(info.Version)
+	return m, true
+}
+
+// selectMods picks the newest version of the mods named in enabled out of
+// available, where "*" means all of them. It's an error for any named mod to
+// be missing.
+func selectMods(available map[string][]mod, enabled []string) ([]mod, error) {
+	var selected []mod
+	var missing []string
+
+	for _, name := range enabled {
+		if name == "*" {
+			selected = selected[:0]
+			for _, versions := range available {
+				selected = append(selected, versions[0])
+			}
+
+			missing = nil
+			break
+		}
+
+		if versions, ok := available[name]; ok {
+			selected = append(selected, versions[0])
+		} else {
+			missing = append(missing, name)
+		}
+	}
+
+	if len(missing) > 0 {
+		return nil, fmt.Errorf("mods not found: %s", strings.Join(missing, ", "))
+	}
+
+	sort.Slice(selected, func(i, j int) bool { return selected[i].Name < selected[j].Name })
+	return selected, nil
+}
+
+// builtinMods are the mods that come with the game rather than living in the
+// mod directory.
+var builtinMods = map[string]bool{
+	"base":           true,
+	"core":           true,
+	"elevated-rails": true,
+	"quality":        true,
+	"space-age":      true,
+}
+
+// syncMods picks the exact versions of the mods the save was made with out of
+// available. If any of them are missing, or only there in another version,
+// the error lists each one that is.
+func syncMods(available map[string][]mod, header *maptorio.SaveHeader) ([]mod, error) {
+	var selected []mod
+	var problems = new(bytes.Buffer)
+	var w = tabwriter.NewWriter(problems, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(w, "MOD\tSAVE\tINSTALLED")
+
+	var bad int
+	for _, sm := range header.Mods {
+		if builtinMods[sm.Name] {
+			continue
+		}
+
+		var found bool
+		var installed []string
+		for _, m := range available[sm.Name] {
+			if m.Version.Compare(sm.Version) == 0 {
+				selected = append(selected, m)
+				found = true
+				break
+			}
+
+			installed = append(installed, m.Version.String())
+		}
+
+		if found {
+			continue
+		}
+
+		bad++
+		if len(installed) == 0 {
+			installed = append(installed, "missing")
+		}
+
+		fmt.Fprintf(w, "%s\t%s\t%s\n", sm.Name, sm.Version, strings.Join(installed, ", "))
+	}
+
+	w.Flush()
+	if bad > 0 {
+		return nil, fmt.Errorf("the save needs mods that aren't installed, put these versions in the mod directory:\n\n%s", problems.String())
+	}
+
+	sort.Slice(selected, func(i, j int) bool { return selected[i].Name < selected[j].Name })
+	return selected, nil
+}
+
+// installMods puts the mods for the save into the workspace mods directory
+// dir and writes the mod-list.json that enables exactly those, along with the
+// base game, the maptorio mod and any mods that ship with the game the save
+// was made with. The mods are the ones named in enabled-mods, or if there
+// aren't any, the ones the save was made with.
+func installMods(c iniconfig, save, dir string) error {
+	var header, err = maptorio.ReadSaveHeader(save)
+	if err != nil {
+		return err
+	}
+
+	var selected []mod
+	var names = []string{"base", "maptorio"}
+	var enable = func(name string) {
+		for _, n := range names {
+			if n == name {
+				return
+			}
+		}
+
+		names = append(names, name)
+	}
+
+	// Mods that ship with the game only need enabling, and the save won't load
+	// without the ones it was made with, eg: space-age
+	var thirdParty bool
+	for _, sm := range header.Mods {
+		if !builtinMods[sm.Name] {
+			thirdParty = true
+		} else if sm.Name != "core" {
+			enable(sm.Name)
+		}
+	}
+
+	if len(c.mods) > 0 {
+		var wanted []string
+		for _, name := range c.mods {
+			if !builtinMods[name] {
+				wanted = append(wanted, name)
+			} else if name != "core" {
+				enable(name)
+			}
+		}
+
+		if len(wanted) > 0 {
+			fmt.Printf("Using mods from %s\n", c.ModDirectory)
+
+			var available map[string][]mod
+			if available, err = findMods(c.ModDirectory); err != nil {
+				return err
+			}
+
+			if selected, err = selectMods(available, wanted); err != nil {
+				return err
+			}
+		}
+	} else if thirdParty {
+		fmt.Printf("Using the mods from the save out of %s\n", c.ModDirectory)
+
+		// A missing mod directory just means none of the mods are installed
+		var available map[string][]mod
+		if available, err = findMods(c.ModDirectory); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+
+		if selected, err = syncMods(available, header); err != nil {
+			return err
+		}
+	}
+
+	for _, m := range selected {
+		fmt.Printf("Enabling mod %s %s\n", m.Name, m.Version)
+
+		if err = linkMod(m.Path, filepath.Join(dir, filepath.Base(m.Path))); err != nil {
+			return err
+		}
+
+		enable(m.Name)
+	}
+
+	// Mod settings change how some mods behave, so bring them along if there are any
+	var settings = filepath.Join(c.ModDirectory, "mod-settings.dat")
+	if _, err = os.Stat(settings); len(selected) > 0 && err == nil {
+		if err = copyFile(settings, filepath.Join(dir, "mod-settings.dat")); err != nil {
+			return err
+		}
+	}
+
+	return writeModList(filepath.Join(dir, "mod-list.json"), names)
+}
+
+// linkMod symlinks the mod at src to dst, falling back to copying it where
+// symlinks aren't available.
+func linkMod(src, dst string) error {
+	if err := os.Symlink(src, dst); err == nil {
+		return nil
+	}
+
+	var fi, err = os.Stat(src)
+	if err != nil {
+		return err
+	}
+
+	if fi.IsDir() {
+		return copyDir(src, dst)
+	}
+
+	return copyFile(src, dst)
+}
+
+// writeModList writes a mod-list.json to path that enables the mods named.
+func writeModList(path string, names []string) error {
+	type entry struct {
+		Name    string `json:"name"`
+		Enabled bool   `json:"enabled"`
+	}
+
+	var list struct {
+		Mods []entry `json:"mods"`
+	}
+
+	for _, name := range names {
+		list.Mods = append(list.Mods, entry{Name: name, Enabled: true})
+	}
+
+	var data, err = json.MarshalIndent(list, "", "    ")
+	if err != nil {
+		return err
+	}
+
+	return ioutil.WriteFile(path, data, 0644)
+}
@@ -0,0 +1,500 @@
+package main
+
+import (
+	"archive/zip"
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strings"
+	"testing"
+
+	"github.com/avidal/maptorio"
+)
+
+// saveHeader encodes the level data header of a save made by version with
+// mods, each given as "name version".
+func saveHeader(t *testing.T, version string, mods ...string) []byte {
+	var v = mustVersion(t, version)
+	var h = new(bytes.Buffer)
+	var str = func(s string) {
+		h.WriteByte(byte(len(s)))
+		h.WriteString(s)
+	}
+
+	binary.Write(h, binary.LittleEndian, v)
+	if v.Compare(maptorio.Version{0, 17, 0}) >= 0 {
+		h.WriteByte(0)
+	}
+
+	str("")
+	str("freeplay")
+	str("base")
+	h.Write([]byte{0, 0, 0}) // difficulty, finished, player won
+	str("")
+	h.Write([]byte{0, 0, 0}) // can continue, finished but continuing, saving replay
+	if v.Compare(maptorio.Version{0, 16, 0}) >= 0 {
+		h.WriteByte(0) // allow non-admin debug options
+	}
+
+	h.Write([]byte{byte(v[0]), byte(v[1]), byte(v[2])})
+	binary.Write(h, binary.LittleEndian, v[3])
+	h.WriteByte(1) // allowed commands
+
+	h.WriteByte(byte(len(mods)))
+	for _, m := range mods {
+		var parts = strings.Fields(m)
+		var mv = mustVersion(t, parts[1])
+		str(parts[0])
+		h.Write([]byte{byte(mv[0]), byte(mv[1]), byte(mv[2])})
+		binary.Write(h, binary.LittleEndian, uint32(0))
+	}
+
+	return h.Bytes()
+}
+
+// writeSave writes a save to path with level as its level.dat.
+func writeSave(t *testing.T, path string, level []byte) {
+	var buf = new(bytes.Buffer)
+	var z = zip.NewWriter(buf)
+	var w, err = z.Create(strings.TrimSuffix(filepath.Base(path), ".zip") + "/level.dat")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	w.Write(level)
+	if err = z.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	writeFile(t, path, buf.String())
+}
+
+// modDir makes a mod directory with the zipped mods given as "name version".
+func modDir(t *testing.T, mods ...string) string {
+	var dir = t.TempDir()
+	for _, m := range mods {
+		var parts = strings.Fields(m)
+		writeFile(t, filepath.Join(dir, parts[0]+"_"+parts[1]+".zip"), m)
+	}
+
+	return dir
+}
+
+// describe lists each mod as "name version file".
+func describe(mods []mod) []string {
+	var out []string
+	for _, m := range mods {
+		out = append(out, m.Name+" "+m.Version.String()+" "+filepath.Base(m.Path))
+	}
+
+	return out
+}
+
+func TestFindMods(t *testing.T) {
+	var dir = modDir(t, "Bottleneck 0.11.6", "Bottleneck 0.11.7", "even-distribution 1.0.10")
+	writeFile(t, filepath.Join(dir, "nover.zip"), "")
+	writeFile(t, filepath.Join(dir, "mod-list.json"), "{}")
+	writeFile(t, filepath.Join(dir, "mod-settings.dat"), "")
+	writeFile(t, filepath.Join(dir, "my_mod_2.0.1", "info.json"), "{}")
+	writeFile(t, filepath.Join(dir, "unpacked", "info.json"), `{"name": "helmod", "version": "2.1.3"}`)
+	writeFile(t, filepath.Join(dir, "unversioned", "info.json"), `{"name": "rusty-locale", "version": "latest"}`)
+	writeFile(t, filepath.Join(dir, "unnamed", "info.json"), `{"version": "1.0.0"}`)
+	writeFile(t, filepath.Join(dir, "broken", "info.json"), `{`)
+	writeFile(t, filepath.Join(dir, "no-info", "data.lua"), "")
+
+	var mods, err = findMods(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var got = map[string][]string{}
+	for name, versions := range mods {
+		got[name] = describe(versions)
+	}
+
+	var want = map[string][]string{
+		"Bottleneck":        {"Bottleneck 0.11.7 Bottleneck_0.11.7.zip", "Bottleneck 0.11.6 Bottleneck_0.11.6.zip"},
+		"even-distribution": {"even-distribution 1.0.10 even-distribution_1.0.10.zip"},
+		"nover":             {"nover 0.0.0 nover.zip"},
+		"my_mod":            {"my_mod 2.0.1 my_mod_2.0.1"},
+		"helmod":            {"helmod 2.1.3 unpacked"},
+		"rusty-locale":      {"rusty-locale 0.0.0 unversioned"},
+		"unnamed":           {"unnamed 1.0.0 unnamed"},
+	}
+
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("found %v, want %v", got, want)
+	}
+
+	if _, err = findMods(filepath.Join(dir, "missing")); !os.IsNotExist(err) {
+		t.Errorf("got %v for a missing mod directory, want it to not exist", err)
+	}
+}
+
+func TestSelectMods(t *testing.T) {
+	var available, err = findMods(modDir(t, "Bottleneck 0.11.6", "Bottleneck 0.11.7", "even-distribution 1.0.10", "helmod 2.1.3"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var tests = []struct {
+		name    string
+		enabled []string
+		want    []string
+		err     string
+	}{
+		{
+			name:    "newest version",
+			enabled: []string{"Bottleneck"},
+			want:    []string{"Bottleneck 0.11.7 Bottleneck_0.11.7.zip"},
+		},
+		{
+			name:    "sorted by name",
+			enabled: []string{"helmod", "Bottleneck"},
+			want:    []string{"Bottleneck 0.11.7 Bottleneck_0.11.7.zip", "helmod 2.1.3 helmod_2.1.3.zip"},
+		},
+		{
+			name:    "all",
+			enabled: []string{"*"},
+			want:    []string{"Bottleneck 0.11.7 Bottleneck_0.11.7.zip", "even-distribution 1.0.10 even-distribution_1.0.10.zip", "helmod 2.1.3 helmod_2.1.3.zip"},
+		},
+		{
+			name:    "all after missing",
+			enabled: []string{"Krastorio2", "*"},
+			want:    []string{"Bottleneck 0.11.7 Bottleneck_0.11.7.zip", "even-distribution 1.0.10 even-distribution_1.0.10.zip", "helmod 2.1.3 helmod_2.1.3.zip"},
+		},
+		{
+			name:    "missing",
+			enabled: []string{"Bottleneck", "Krastorio2", "flib"},
+			err:     "mods not found: Krastorio2, flib",
+		},
+		{
+			name:    "names are case sensitive",
+			enabled: []string{"bottleneck"},
+			err:     "mods not found: bottleneck",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var got, err = selectMods(available, tt.enabled)
+			if tt.err != "" {
+				if err == nil || err.Error() != tt.err {
+					t.Fatalf("got error %v, want %q", err, tt.err)
+				}
+
+				return
+			}
+
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if !reflect.DeepEqual(describe(got), tt.want) {
+				t.Errorf("selected %v, want %v", describe(got), tt.want)
+			}
+		})
+	}
+}
+
+func TestInstallMods(t *testing.T) {
+	var tests = []struct {
+		name     string
+		enabled  string
+		save     []string
+		mods     []string
+		noModDir bool
+		enables  []string
+		links    []string
+		err      string
+	}{
+		{
+			name:    "enabled mods",
+			enabled: "Bottleneck",
+			save:    []string{"base 1.1.100"},
+			mods:    []string{"Bottleneck 0.11.6", "Bottleneck 0.11.7", "helmod 2.1.3"},
+			enables: []string{"base", "maptorio", "Bottleneck"},
+			links:   []string{"Bottleneck_0.11.7.zip"},
+		},
+		{
+			name:    "enabled mods keep the save's built in mods",
+			enabled: "Bottleneck",
+			save:    []string{"base 2.0.60", "elevated-rails 2.0.60", "quality 2.0.60", "space-age 2.0.60", "helmod 2.1.3"},
+			mods:    []string{"Bottleneck 0.11.7", "helmod 2.1.3"},
+			enables: []string{"base", "maptorio", "elevated-rails", "quality", "space-age", "Bottleneck"},
+			links:   []string{"Bottleneck_0.11.7.zip"},
+		},
+		{
+			name:     "built in mods aren't looked for in the mod directory",
+			enabled:  "core, quality",
+			save:     []string{"base 2.0.60"},
+			noModDir: true,
+			enables:  []string{"base", "maptorio", "quality"},
+		},
+		{
+			name:    "missing enabled mod",
+			enabled: "Bottleneck, Krastorio2",
+			save:    []string{"base 1.1.100"},
+			mods:    []string{"Bottleneck 0.11.7"},
+			err:     "mods not found: Krastorio2",
+		},
+		{
+			name:    "the save's mods",
+			save:    []string{"base 2.0.60", "space-age 2.0.60", "Bottleneck 0.11.6"},
+			mods:    []string{"Bottleneck 0.11.6", "Bottleneck 0.11.7", "helmod 2.1.3"},
+			enables: []string{"base", "maptorio", "space-age", "Bottleneck"},
+			links:   []string{"Bottleneck_0.11.6.zip"},
+		},
+		{
+			name:     "only built in mods need no mod directory",
+			save:     []string{"base 2.0.60", "elevated-rails 2.0.60", "quality 2.0.60", "space-age 2.0.60"},
+			noModDir: true,
+			enables:  []string{"base", "maptorio", "elevated-rails", "quality", "space-age"},
+		},
+		{
+			name:     "the save's mods missing",
+			save:     []string{"base 1.1.100", "Bottleneck 0.11.6"},
+			noModDir: true,
+			err:      "the save needs mods that aren't installed",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var root = t.TempDir()
+			var save = filepath.Join(root, "railworld.zip")
+			writeSave(t, save, saveHeader(t, strings.Fields(tt.save[0])[1], tt.save...))
+
+			var c = iniconfig{ModDirectory: filepath.Join(root, "missing"), mods: parseList(tt.enabled)}
+			if !tt.noModDir {
+				c.ModDirectory = modDir(t, tt.mods...)
+				writeFile(t, filepath.Join(c.ModDirectory, "mod-settings.dat"), "settings")
+			}
+
+			var dir = filepath.Join(root, "workspace", "mods")
+			if err := os.MkdirAll(dir, os.ModePerm); err != nil {
+				t.Fatal(err)
+			}
+
+			var err = installMods(c, save, dir)
+			if tt.err != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.err) {
+					t.Fatalf("got error %v, want one about %q", err, tt.err)
+				}
+
+				return
+			}
+
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			var list struct {
+				Mods []struct {
+					Name    string `json:"name"`
+					Enabled bool   `json:"enabled"`
+				} `json:"mods"`
+			}
+
+			var data []byte
+			if data, err = ioutil.ReadFile(filepath.Join(dir, "mod-list.json")); err != nil {
+				t.Fatal(err)
+			}
+
+			if err = json.Unmarshal(data, &list); err != nil {
+				t.Fatal(err)
+			}
+
+			var enables []string
+			for _, m := range list.Mods {
+				if m.Enabled {
+					enables = append(enables, m.Name)
+				}
+			}
+
+			if !reflect.DeepEqual(enables, tt.enables) {
+				t.Errorf("mod-list.json enables %v, want %v", enables, tt.enables)
+			}
+
+			var links []string
+			var entries, _ = ioutil.ReadDir(dir)
+			for _, e := range entries {
+				if strings.HasSuffix(e.Name(), ".zip") {
+					links = append(links, e.Name())
+				}
+			}
+
+			sort.Strings(links)
+			if !reflect.DeepEqual(links, tt.links) {
+				t.Errorf("installed %v, want %v", links, tt.links)
+			}
+
+			// The settings only come along with the mods they're for
+			var _, serr = os.Stat(filepath.Join(dir, "mod-settings.dat"))
+			if len(tt.links) > 0 && serr != nil {
+				t.Errorf("mod-settings.dat not copied: %s", serr)
+			} else if len(tt.links) == 0 && serr == nil {
+				t.Error("mod-settings.dat copied without any mods")
+			}
+		})
+	}
+}
+
+func TestLinkMod(t *testing.T) {
+	var src = t.TempDir()
+	writeFile(t, filepath.Join(src, "Bottleneck_0.11.7.zip"), "zip")
+	writeFile(t, filepath.Join(src, "helmod", "info.json"), "{}")
+
+	for _, name := range []string{"Bottleneck_0.11.7.zip", "helmod"} {
+		t.Run(name, func(t *testing.T) {
+			var dst = filepath.Join(t.TempDir(), name)
+			if err := linkMod(filepath.Join(src, name), dst); err != nil {
+				t.Fatal(err)
+			}
+
+			if fi, err := os.Lstat(dst); err != nil || fi.Mode()&os.ModeSymlink == 0 {
+				t.Errorf("%s isn't a link: %v", dst, err)
+			}
+
+			// Where a link can't be made, here because something's in the way, the
+			// mod is copied
+			var blocked = filepath.Join(t.TempDir(), name)
+			if strings.HasSuffix(name, ".zip") {
+				writeFile(t, blocked, "old")
+			} else if err := os.Mkdir(blocked, os.ModePerm); err != nil {
+				t.Fatal(err)
+			}
+
+			if err := linkMod(filepath.Join(src, name), blocked); err != nil {
+				t.Fatal(err)
+			}
+
+			var path, want = blocked, "zip"
+			if !strings.HasSuffix(name, ".zip") {
+				path, want = filepath.Join(blocked, "info.json"), "{}"
+			}
+
+			var data, err = ioutil.ReadFile(path)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if string(data) != want {
+				t.Errorf("copied %q, want %q", data, want)
+			}
+		})
+	}
+
+	if err := linkMod(filepath.Join(src, "missing.zip"), filepath.Join(src, "Bottleneck_0.11.7.zip")); err == nil {
+		t.Error("linked a mod that doesn't exist")
+	}
+}
+
+// fixtureSave writes a save with the header fixture for version out of the
+// repository's testdata, returning its path.
+func fixtureSave(t *testing.T, version string) string {
+	var data, err = ioutil.ReadFile(filepath.Join("..", "testdata", "headers", version+".dat"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var save = filepath.Join(t.TempDir(), "railworld.zip")
+	writeSave(t, save, data)
+	return save
+}
+
+func fixtureHeader(t *testing.T, version string) *maptorio.SaveHeader {
+	var h, err = maptorio.ReadSaveHeader(fixtureSave(t, version))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return h
+}
+
+func TestSyncMods(t *testing.T) {
+	var tests = []struct {
+		name    string
+		save    string
+		mods    []string
+		want    []string
+		missing [][]string
+	}{
+		{
+			name: "installed",
+			save: "1.1.110",
+			mods: []string{"flib 0.12.8", "flib 0.12.9", "Krastorio2 1.3.24", "helmod 2.1.3"},
+			want: []string{"Krastorio2 1.3.24 Krastorio2_1.3.24.zip", "flib 0.12.9 flib_0.12.9.zip"},
+		},
+		{
+			name:    "other versions",
+			save:    "1.1.110",
+			mods:    []string{"flib 0.12.8", "flib 0.13.0", "Krastorio2 1.3.24"},
+			missing: [][]string{{"flib", "0.12.9", "0.13.0,", "0.12.8"}},
+		},
+		{
+			name:    "missing",
+			save:    "0.17.79",
+			mods:    []string{"Bottleneck 0.11.4"},
+			missing: [][]string{{"even-distribution", "0.3.21", "missing"}},
+		},
+		{
+			name:    "no mods installed",
+			save:    "0.17.79",
+			missing: [][]string{{"Bottleneck", "0.11.4", "missing"}, {"even-distribution", "0.3.21", "missing"}},
+		},
+		{
+			name: "built in mods are skipped",
+			save: "2.0.60",
+			mods: []string{"Bottleneck 0.12.1"},
+			want: []string{"Bottleneck 0.12.1 Bottleneck_0.12.1.zip"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var available, err = findMods(modDir(t, tt.mods...))
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			var got []mod
+			got, err = syncMods(available, fixtureHeader(t, tt.save))
+			if len(tt.missing) > 0 {
+				if err == nil {
+					t.Fatalf("synced %v, want an error", describe(got))
+				}
+
+				// The rows after the heading, in order
+				var lines = strings.Split(strings.TrimSpace(err.Error()), "\n")
+				var rows [][]string
+				for i, line := range lines {
+					if strings.HasPrefix(line, "MOD") {
+						for _, row := range lines[i+1:] {
+							rows = append(rows, strings.Fields(row))
+						}
+					}
+				}
+
+				if !reflect.DeepEqual(rows, tt.missing) {
+					t.Errorf("got error %s\nwant rows %v", err, tt.missing)
+				}
+
+				return
+			}
+
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if !reflect.DeepEqual(describe(got), tt.want) {
+				t.Errorf("synced %v, want %v", describe(got), tt.want)
+			}
+		})
+	}
+}
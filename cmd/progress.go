@@ -0,0 +1,297 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/cheggaaa/pb"
+	"github.com/fsnotify/fsnotify"
+)
+
+// renderManifest is the plan the mod writes to maptorio/manifest.json in the
+// script output before it takes any screenshots.
+type renderManifest struct {
+	Zoom       int `json:"zoom"`
+	Resolution int `json:"resolution"`
+	Surfaces   []struct {
+		surface
+
+		Chunks []struct {
+			X        int `json:"x"`
+			Y        int `json:"y"`
+			Position struct {
+				X int `json:"x"`
+				Y int `json:"y"`
+			} `json:"position"`
+			Path string `json:"path"`
+		} `json:"chunks"`
+	} `json:"surfaces"`
+}
+
+// surfaces returns the surfaces in the manifest.
+func (m *renderManifest) surfaces() []surface {
+	var surfaces = make([]surface, 0, len(m.Surfaces))
+	for _, s := range m.Surfaces {
+		surfaces = append(surfaces, s.surface)
+	}
+
+	return surfaces
+}
+
+// chunks returns the number of screenshots in the manifest.
+func (m *renderManifest) chunks() int {
+	var n int
+	for _, s := range m.Surfaces {
+		n += len(s.Chunks)
+	}
+
+	return n
+}
+
+// settleTime is how long the screenshots have to stay untouched after the
+// last one shows up before they're taken to be finished. The game creates each
+// file before it's done writing it. It's a variable so tests can shorten it.
+var settleTime = 2 * time.Second
+
+// progress follows the game as it works through a render by watching what
+// the mod writes to the script output directory.
+type progress struct {
+	so      string
+	dir     string
+	watcher *fsnotify.Watcher
+
+	// tiles are the directories the screenshots go in, one for each surface
+	tiles map[string]bool
+
+	manifest *renderManifest
+	written  map[string]bool
+	done     bool
+	bar      *pb.ProgressBar
+}
+
+// watchProgress starts watching the script output directory so. It has to be
+// called before the game starts so nothing is missed.
+func watchProgress(so string) (*progress, error) {
+	var p = &progress{
+		so:      so,
+		dir:     filepath.Join(so, "maptorio"),
+		tiles:   make(map[string]bool),
+		written: make(map[string]bool),
+	}
+
+	// The directory has to exist to be watched, the game doesn't mind it being there already
+	if err := os.MkdirAll(p.dir, os.ModePerm); err != nil {
+		return nil, err
+	}
+
+	var err error
+	if p.watcher, err = fsnotify.NewWatcher(); err != nil {
+		return nil, err
+	}
+
+	if err = p.watcher.Add(p.dir); err != nil {
+		p.watcher.Close()
+		return nil, err
+	}
+
+	return p, nil
+}
+
+// watchTiles starts watching the directory each screenshot in the manifest
+// goes in, then takes in any screenshots that were written before it was.
+func (p *progress) watchTiles() error {
+	for _, s := range p.manifest.Surfaces {
+		for _, c := range s.Chunks {
+			var dir = filepath.Dir(filepath.Join(p.so, filepath.FromSlash(c.Path)))
+			if p.tiles[dir] {
+				continue
+			}
+
+			if err := os.MkdirAll(dir, os.ModePerm); err != nil {
+				return err
+			}
+
+			if err := p.watcher.Add(dir); err != nil {
+				return err
+			}
+
+			p.tiles[dir] = true
+
+			var existing, _ = filepath.Glob(filepath.Join(dir, "*"))
+			for _, path := range existing {
+				p.update(path)
+			}
+		}
+	}
+
+	return nil
+}
+
+// Wait blocks until every screenshot in the manifest has been written. It
+// gives up if nothing is written to the script output for the stall timeout,
+// which covers loading the save as well as taking the screenshots, or if
+// either of those takes longer than its own timeout.
+func (p *progress) Wait(ctx context.Context, limits timeouts) error {
+	var stalled = time.NewTimer(limits.Stall)
+	defer stalled.Stop()
+
+	var settled = time.NewTimer(settleTime)
+	settled.Stop()
+
+	// A nil channel never fires, which is what no limit means
+	var phase <-chan time.Time
+	var phaseTimer *time.Timer
+	if limits.Load > 0 {
+		phaseTimer = time.NewTimer(limits.Load)
+		phase = phaseTimer.C
+	}
+
+	defer func() {
+		if phaseTimer != nil {
+			phaseTimer.Stop()
+		}
+	}()
+
+	fmt.Println("Waiting for the game to load the save...")
+
+	for {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+
+		case err := <-p.watcher.Errors:
+			return err
+
+		case ev := <-p.watcher.Events:
+			if !ev.Has(fsnotify.Create) && !ev.Has(fsnotify.Write) && !ev.Has(fsnotify.Rename) {
+				continue
+			}
+
+			var loaded = p.manifest != nil
+			if err := p.update(ev.Name); err != nil {
+				return err
+			}
+
+			// Loading is over once the manifest shows up, and the screenshots have their own limit
+			if !loaded && p.manifest != nil {
+				if phaseTimer != nil {
+					phaseTimer.Stop()
+				}
+
+				phaseTimer, phase = nil, nil
+				if limits.Screenshots > 0 {
+					phaseTimer = time.NewTimer(limits.Screenshots)
+					phase = phaseTimer.C
+				}
+			}
+
+			stalled.Reset(limits.Stall)
+			if p.complete() {
+				settled.Reset(settleTime)
+			}
+
+		case <-settled.C:
+			if p.complete() {
+				return nil
+			}
+
+		case <-stalled.C:
+			if p.manifest == nil {
+				return fmt.Errorf("the game didn't start rendering within %s", limits.Stall)
+			}
+
+			return fmt.Errorf("the game stopped rendering, %d of %d screenshots were written in %s", len(p.written), p.manifest.chunks(), limits.Stall)
+
+		case <-phase:
+			if p.manifest == nil {
+				return fmt.Errorf("the game took longer than %s to load the save", limits.Load)
+			}
+
+			return fmt.Errorf("the game took longer than %s to take the screenshots, %d of %d were written", limits.Screenshots, len(p.written), p.manifest.chunks())
+		}
+	}
+}
+
+// update takes in a change to the file at path.
+func (p *progress) update(path string) error {
+	if p.tiles[filepath.Dir(path)] {
+		var rel, err = filepath.Rel(p.so, path)
+		if err != nil {
+			return err
+		}
+
+		if rel = filepath.ToSlash(rel); !p.written[rel] {
+			p.written[rel] = true
+			p.bar.Increment()
+		}
+
+		return nil
+	}
+
+	switch filepath.Base(path) {
+	case "manifest.json":
+		// The manifest may only be partly written, in which case there'll be another event
+		// for the rest of it
+		if p.manifest != nil {
+			return nil
+		}
+
+		var data, err = ioutil.ReadFile(path)
+		if err != nil {
+			return nil
+		}
+
+		var m renderManifest
+		if json.Unmarshal(data, &m) != nil {
+			return nil
+		}
+
+		p.manifest = &m
+		fmt.Printf("Rendering %d chunks of %d surfaces\n", m.chunks(), len(m.Surfaces))
+
+		p.bar = pb.StartNew(m.chunks())
+		return p.watchTiles()
+
+	case "progress":
+		var data, err = ioutil.ReadFile(path)
+		if err != nil {
+			return nil
+		}
+
+		p.done = bytes.Contains(data, []byte("done "))
+	}
+
+	return nil
+}
+
+// complete reports whether the mod has asked for every screenshot in the
+// manifest and all of them have shown up.
+func (p *progress) complete() bool {
+	if p.manifest == nil || !p.done {
+		return false
+	}
+
+	for _, s := range p.manifest.Surfaces {
+		for _, c := range s.Chunks {
+			if !p.written[c.Path] {
+				return false
+			}
+		}
+	}
+
+	return true
+}
+
+func (p *progress) Close() error {
+	if p.bar != nil {
+		p.bar.Finish()
+	}
+
+	return p.watcher.Close()
+}
@@ -0,0 +1,179 @@
+package main
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+const testManifest = `{"zoom":9,"resolution":512,"surfaces":[{"name":"nauvis","dir":"nauvis","chunks":[
+	{"x":0,"y":0,"position":{"x":16,"y":16},"path":"tiles/nauvis/9/0x0.jpg"},
+	{"x":-1,"y":0,"position":{"x":-16,"y":16},"path":"tiles/nauvis/9/-1x0.jpg"}]}]}`
+
+// newTestProgress watches a temporary script output directory, returning it
+// along with the progress.
+func newTestProgress(t *testing.T) (*progress, string) {
+	var so = t.TempDir()
+	var p, err = watchProgress(so)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	t.Cleanup(func() { p.Close() })
+	return p, so
+}
+
+// script writes each of files to the script output so, in order and with
+// delay between them, the way the mod would.
+func script(t *testing.T, so string, delay time.Duration, files ...string) {
+	var done = make(chan struct{})
+	t.Cleanup(func() { <-done })
+
+	go func() {
+		defer close(done)
+		for i := 0; i+1 < len(files); i += 2 {
+			time.Sleep(delay)
+
+			var path = filepath.Join(so, filepath.FromSlash(files[i]))
+			if err := os.MkdirAll(filepath.Dir(path), os.ModePerm); err != nil {
+				t.Error(err)
+				return
+			}
+
+			if err := ioutil.WriteFile(path, []byte(files[i+1]), 0644); err != nil {
+				t.Error(err)
+				return
+			}
+		}
+	}()
+}
+
+func TestProgressPartialManifest(t *testing.T) {
+	var p, so = newTestProgress(t)
+	var path = filepath.Join(so, "maptorio", "manifest.json")
+
+	// The game may still be writing it
+	writeFile(t, path, testManifest[:40])
+	if err := p.update(path); err != nil || p.manifest != nil {
+		t.Fatalf("took in a partial manifest: %v, %v", p.manifest, err)
+	}
+
+	writeFile(t, path, testManifest)
+	if err := p.update(path); err != nil || p.manifest == nil {
+		t.Fatalf("didn't take in the manifest: %v", err)
+	}
+
+	if p.manifest.chunks() != 2 || !p.tiles[filepath.Join(so, "tiles", "nauvis", "9")] {
+		t.Errorf("manifest has %d chunks in %v, want 2 in tiles/nauvis/9", p.manifest.chunks(), p.tiles)
+	}
+
+	// Once it's in, rewrites of it are left alone
+	writeFile(t, path, `{"surfaces":[]}`)
+	if err := p.update(path); err != nil || p.manifest.chunks() != 2 {
+		t.Errorf("manifest replaced: %v", err)
+	}
+
+	for _, c := range []string{"0x0", "-1x0"} {
+		if err := p.update(filepath.Join(so, "tiles", "nauvis", "9", c+".jpg")); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if p.complete() {
+		t.Error("complete before the mod said it was done")
+	}
+
+	writeFile(t, filepath.Join(so, "maptorio", "progress"), "requested 1\ndone 2\n")
+	if err := p.update(filepath.Join(so, "maptorio", "progress")); err != nil || !p.complete() {
+		t.Errorf("not complete with every screenshot written: %v", err)
+	}
+}
+
+func TestProgressWait(t *testing.T) {
+	var saved = settleTime
+	settleTime = 300 * time.Millisecond
+	defer func() { settleTime = saved }()
+
+	var done = []string{
+		"maptorio/manifest.json", testManifest,
+		"tiles/nauvis/9/0x0.jpg", "jpg",
+		"tiles/nauvis/9/-1x0.jpg", "jpg",
+		"maptorio/progress", "done 2\n",
+	}
+
+	var tests = []struct {
+		name   string
+		limits timeouts
+		files  []string
+		err    string
+	}{
+		{
+			name:   "done",
+			limits: timeouts{Stall: 5 * time.Second},
+			files:  done,
+		},
+		{
+			name:   "no manifest",
+			limits: timeouts{Stall: 200 * time.Millisecond},
+			files:  []string{"maptorio/progress", ""},
+			err:    "the game didn't start rendering within 200ms",
+		},
+		{
+			name:   "stalled",
+			limits: timeouts{Stall: 200 * time.Millisecond},
+			files:  done[:4],
+			err:    "the game stopped rendering, 1 of 2 screenshots were written in 200ms",
+		},
+		{
+			name:   "never done",
+			limits: timeouts{Stall: 200 * time.Millisecond},
+			files:  done[:6],
+			err:    "the game stopped rendering, 2 of 2 screenshots were written in 200ms",
+		},
+		{
+			name:   "load timeout",
+			limits: timeouts{Stall: 5 * time.Second, Load: 200 * time.Millisecond},
+			err:    "the game took longer than 200ms to load the save",
+		},
+		{
+			name:   "screenshots timeout",
+			limits: timeouts{Stall: 5 * time.Second, Load: 5 * time.Second, Screenshots: 200 * time.Millisecond},
+			files:  done[:4],
+			err:    "the game took longer than 200ms to take the screenshots, 1 of 2 were written",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var p, so = newTestProgress(t)
+			script(t, so, 20*time.Millisecond, tt.files...)
+
+			var start = time.Now()
+			var err = p.Wait(context.Background(), tt.limits)
+			if tt.err == "" && err != nil {
+				t.Fatal(err)
+			} else if tt.err != "" && (err == nil || !strings.Contains(err.Error(), tt.err)) {
+				t.Fatalf("got error %v, want %q", err, tt.err)
+			}
+
+			// Finishing waits for the screenshots to settle after the last write
+			if tt.err == "" && time.Since(start) < settleTime {
+				t.Errorf("finished in %s, before the screenshots settled", time.Since(start))
+			}
+		})
+	}
+}
+
+func TestProgressWaitCancelled(t *testing.T) {
+	var p, _ = newTestProgress(t)
+	var ctx, cancel = context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+
+	if err := p.Wait(ctx, timeouts{Stall: 5 * time.Second}); err != context.DeadlineExceeded {
+		t.Errorf("got %v, want %v", err, context.DeadlineExceeded)
+	}
+}
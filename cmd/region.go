@@ -0,0 +1,168 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// region is the part of the map to render, in chunks. Right and Bottom are
+// the last chunks in it, not the first ones past it.
+type region struct {
+	Name   string `json:"name,omitempty"`
+	Left   int    `json:"left"`
+	Top    int    `json:"top"`
+	Right  int    `json:"right"`
+	Bottom int    `json:"bottom"`
+}
+
+// parseRegion parses a bounding box of the map, eg: -200,-1000,200,1000 for
+// the area between those two positions in the world, or chunk:-7,-32,6,31 for
+// the chunks from -7x-32 to 6x31.
+func parseRegion(spec string) (region, error) {
+	var r region
+	var box = spec
+	var chunks = strings.HasPrefix(box, "chunk:")
+	box = strings.TrimPrefix(strings.TrimPrefix(box, "chunk:"), "world:")
+
+	var parts = strings.Split(box, ",")
+	if len(parts) != 4 {
+		return r, fmt.Errorf("invalid region '%s', must be x1,y1,x2,y2 or chunk:x1,y1,x2,y2", spec)
+	}
+
+	var n [4]int
+	for i, part := range parts {
+		var err error
+		if n[i], err = strconv.Atoi(strings.TrimSpace(part)); err != nil {
+			return r, fmt.Errorf("invalid region '%s', %s is not a whole number", spec, strings.TrimSpace(part))
+		}
+	}
+
+	// Either corner can come first
+	var x1, y1, x2, y2 = n[0], n[1], n[2], n[3]
+	if x1 > x2 {
+		x1, x2 = x2, x1
+	}
+
+	if y1 > y2 {
+		y1, y2 = y2, y1
+	}
+
+	if chunks {
+		return region{Left: x1, Top: y1, Right: x2, Bottom: y2}, nil
+	}
+
+	// Positions are game tiles, 32 to a chunk. The far edge of the box isn't in it,
+	// the same as a bounding box in the game
+	if x1 == x2 || y1 == y2 {
+		return r, fmt.Errorf("invalid region '%s', it's empty", spec)
+	}
+
+	return region{Left: floorDiv(x1, 32), Top: floorDiv(y1, 32), Right: floorDiv(x2-1, 32), Bottom: floorDiv(y2-1, 32)}, nil
+}
+
+// selectRegion picks the region to render: spec if it's set, otherwise the
+// region setting. Either one is a bounding box for parseRegion or the name of
+// one in the config's [regions] section. With neither the whole map is
+// rendered.
+func (c *iniconfig) selectRegion(spec string) error {
+	if spec == "" {
+		spec = c.Region
+	}
+
+	if spec = strings.TrimSpace(spec); spec == "" {
+		c.region = nil
+		return nil
+	}
+
+	var r region
+	var err error
+	if box, ok := c.regions[spec]; ok {
+		if r, err = parseRegion(box); err != nil {
+			return fmt.Errorf("region %s: %s", spec, err)
+		}
+
+		r.Name = spec
+	} else if !strings.Contains(spec, ",") {
+		return fmt.Errorf("no region called %s in the [regions] section of the config", spec)
+	} else if r, err = parseRegion(spec); err != nil {
+		return err
+	}
+
+	c.region = &r
+	return nil
+}
+
+// floorDiv divides a by b rounding down, rather than towards zero.
+func floorDiv(a, b int) int {
+	var q = a / b
+	if a%b != 0 && (a < 0) != (b < 0) {
+		q--
+	}
+
+	return q
+}
+
+// unsafeDirChars are the characters that surface_dir in the mod replaces in
+// surface names, so the directories region names end up in follow the same
+// rules.
+var unsafeDirChars = regexp.MustCompile(`[^A-Za-z0-9_-]`)
+
+// dir returns what's added to the output directory for a map of the region,
+// its name with anything that's unsafe in a path replaced, or just region if
+// it doesn't have one.
+func (r region) dir() string {
+	if r.Name == "" {
+		return "region"
+	}
+
+	return unsafeDirChars.ReplaceAllString(r.Name, "_")
+}
+
+// box returns the region as chunk coordinates that parseRegion reads back.
+func (r region) box() string {
+	return fmt.Sprintf("chunk:%d,%d,%d,%d", r.Left, r.Top, r.Right, r.Bottom)
+}
+
+// writeRegion records the region the map in od was rendered for, or that it's
+// the whole map when r is nil.
+func writeRegion(od string, r *region) error {
+	var path = filepath.Join(od, "region.json")
+	if r == nil {
+		if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+
+		return nil
+	}
+
+	var data, err = json.MarshalIndent(r, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	return ioutil.WriteFile(path, data, 0644)
+}
+
+// readRegion returns the region the map in od was rendered for, nil if it's
+// the whole map.
+func readRegion(od string) (*region, error) {
+	var data, err = ioutil.ReadFile(filepath.Join(od, "region.json"))
+	if os.IsNotExist(err) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+
+	var r region
+	if err = json.Unmarshal(data, &r); err != nil {
+		return nil, err
+	}
+
+	return &r, nil
+}
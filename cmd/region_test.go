@@ -0,0 +1,146 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestParseRegion(t *testing.T) {
+	var tests = []struct {
+		spec string
+		want region
+		err  string
+	}{
+		{spec: "-200,-1000,200,1000", want: region{Left: -7, Top: -32, Right: 6, Bottom: 31}},
+		{spec: "world:-200,-1000,200,1000", want: region{Left: -7, Top: -32, Right: 6, Bottom: 31}},
+		{spec: "200, 1000, -200, -1000", want: region{Left: -7, Top: -32, Right: 6, Bottom: 31}},
+		{spec: "0,0,32,32", want: region{Left: 0, Top: 0, Right: 0, Bottom: 0}},
+		{spec: "0,0,33,33", want: region{Left: 0, Top: 0, Right: 1, Bottom: 1}},
+		{spec: "-1,-1,0,0", want: region{Left: -1, Top: -1, Right: -1, Bottom: -1}},
+		{spec: "-33,-64,-32,-33", want: region{Left: -2, Top: -2, Right: -2, Bottom: -2}},
+		{spec: "chunk:-7,-32,6,31", want: region{Left: -7, Top: -32, Right: 6, Bottom: 31}},
+		{spec: "chunk:6,31,-7,-32", want: region{Left: -7, Top: -32, Right: 6, Bottom: 31}},
+		{spec: "chunk:-3,-3,-3,-3", want: region{Left: -3, Top: -3, Right: -3, Bottom: -3}},
+		{spec: "1,2,3", err: "must be x1,y1,x2,y2"},
+		{spec: "1,2,3,4,5", err: "must be x1,y1,x2,y2"},
+		{spec: "chunk:", err: "must be x1,y1,x2,y2"},
+		{spec: "1,2,3,x", err: "x is not a whole number"},
+		{spec: "1.5,2,3,4", err: "1.5 is not a whole number"},
+		{spec: "5,0,5,100", err: "it's empty"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.spec, func(t *testing.T) {
+			var got, err = parseRegion(tt.spec)
+			if tt.err != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.err) {
+					t.Fatalf("got %+v, %v, want an error about %q", got, err, tt.err)
+				}
+
+				return
+			}
+
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if got != tt.want {
+				t.Errorf("got %+v, want %+v", got, tt.want)
+			}
+
+			// The region's box reads back as the same region
+			if back, err := parseRegion(got.box()); err != nil || back != got {
+				t.Errorf("%s read back as %+v, %v", got.box(), back, err)
+			}
+		})
+	}
+}
+
+func TestSelectRegion(t *testing.T) {
+	var regions = map[string]string{
+		"bus":    "-200,-1000,200,1000",
+		"spawn":  "chunk:-2,-2,1,1",
+		"broken": "1,2,3",
+	}
+
+	var tests = []struct {
+		name    string
+		setting string
+		spec    string
+		want    *region
+		err     string
+	}{
+		{name: "neither", want: nil},
+		{name: "blank", setting: "  ", spec: " ", want: nil},
+		{name: "setting", setting: "chunk:0,0,1,1", want: &region{Right: 1, Bottom: 1}},
+		{name: "flag over setting", setting: "spawn", spec: "chunk:-1,-1,0,0", want: &region{Left: -1, Top: -1}},
+		{name: "named", spec: " bus ", want: &region{Name: "bus", Left: -7, Top: -32, Right: 6, Bottom: 31}},
+		{name: "named setting", setting: "spawn", want: &region{Name: "spawn", Left: -2, Top: -2, Right: 1, Bottom: 1}},
+		{name: "unknown name", spec: "factory", err: "no region called factory"},
+		{name: "bad named region", spec: "broken", err: "region broken: invalid region"},
+		{name: "bad box", spec: "1,2,x,4", err: "x is not a whole number"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			// A region picked before is replaced
+			var c = iniconfig{Region: tt.setting, regions: regions, region: &region{Name: "old"}}
+			var err = c.selectRegion(tt.spec)
+			if tt.err != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.err) {
+					t.Fatalf("got %v, want an error about %q", err, tt.err)
+				}
+
+				return
+			}
+
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if (c.region == nil) != (tt.want == nil) || (c.region != nil && *c.region != *tt.want) {
+				t.Errorf("selected %+v, want %+v", c.region, tt.want)
+			}
+		})
+	}
+}
+
+func TestFloorDiv(t *testing.T) {
+	var tests = []struct{ a, b, want int }{
+		{0, 32, 0},
+		{31, 32, 0},
+		{32, 32, 1},
+		{-1, 32, -1},
+		{-32, 32, -1},
+		{-33, 32, -2},
+		{-64, 32, -2},
+		{5, -2, -3},
+		{-5, -2, 2},
+	}
+
+	for _, tt := range tests {
+		if got := floorDiv(tt.a, tt.b); got != tt.want {
+			t.Errorf("floorDiv(%d, %d) = %d, want %d", tt.a, tt.b, got, tt.want)
+		}
+	}
+}
+
+func TestRegionDir(t *testing.T) {
+	var tests = []struct {
+		name string
+		want string
+	}{
+		{"", "region"},
+		{"bus", "bus"},
+		{"main-bus_2", "main-bus_2"},
+		{"main bus", "main_bus"},
+		{"../../etc", "______etc"},
+		{`C:\maps`, "C__maps"},
+	}
+
+	for _, tt := range tests {
+		if got := (region{Name: tt.name}).dir(); got != tt.want {
+			t.Errorf("region %q goes in %q, want %q", tt.name, got, tt.want)
+		}
+	}
+}
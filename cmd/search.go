@@ -0,0 +1,85 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// searchDump is what the mod writes to maptorio/search.json in the script
+// output: the train stops, map tags and players on every surface that was
+// rendered.
+type searchDump struct {
+	Surfaces []struct {
+		surface
+
+		Results []struct {
+			Name string  `json:"name"`
+			Kind string  `json:"kind"`
+			X    float64 `json:"x"`
+			Y    float64 `json:"y"`
+		} `json:"results"`
+	} `json:"surfaces"`
+}
+
+// searchResult is one thing the viewer's search box can find. Coordinates
+// are in the map's L.CRS.Simple space, the same as the overlays, and X and Y
+// are the position in the game.
+type searchResult struct {
+	Name        string     `json:"name"`
+	Kind        string     `json:"kind"`
+	Surface     string     `json:"surface"`
+	X           float64    `json:"x"`
+	Y           float64    `json:"y"`
+	Coordinates [2]float64 `json:"coordinates"`
+}
+
+// writeSearch converts the search index the mod wrote to the script output so
+// into search.json in od, sorted by name, replacing any from before.
+func writeSearch(so, od string) error {
+	var path = filepath.Join(od, "search.json")
+	if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+
+	var data, err = ioutil.ReadFile(filepath.Join(so, "maptorio", "search.json"))
+	if os.IsNotExist(err) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+
+	var dump searchDump
+	if err = json.Unmarshal(data, &dump); err != nil {
+		return fmt.Errorf("invalid search index from the mod: %s", err)
+	}
+
+	var results = []searchResult{}
+	for _, s := range dump.Surfaces {
+		for _, r := range s.Results {
+			results = append(results, searchResult{
+				Name:        r.Name,
+				Kind:        r.Kind,
+				Surface:     s.Dir,
+				X:           r.X,
+				Y:           r.Y,
+				Coordinates: [2]float64{r.X / 32, -r.Y / 32},
+			})
+		}
+	}
+
+	sort.SliceStable(results, func(i, j int) bool {
+		return strings.ToLower(results[i].Name) < strings.ToLower(results[j].Name)
+	})
+
+	if data, err = json.Marshal(results); err != nil {
+		return err
+	}
+
+	fmt.Printf("Indexed %d train stops, map tags and players for searching\n", len(results))
+	return ioutil.WriteFile(path, data, 0644)
+}
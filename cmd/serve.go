@@ -0,0 +1,323 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"mime"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/avidal/maptorio"
+)
+
+// tileReader is the part of a tile archive the server needs.
+type tileReader interface {
+	ReadTile(z, x, y int) ([]byte, error)
+	ReadMetadata() (maptorio.Metadata, error)
+	Close() error
+}
+
+// server serves a generated map over HTTP. Tiles come from each surface's
+// archive if there are any, otherwise everything is served straight from the
+// map's directory.
+type server struct {
+	dir string
+
+	// archives are keyed by surface directory, and empty when tiles are
+	// served from dir/tiles. They all share meta's format and tile size.
+	archives map[string]tileReader
+	surfaces []surface
+	region   *region
+	meta     maptorio.Metadata
+	modtime  time.Time
+
+	// index is the viewer to serve instead of the index.html in dir, when
+	// there isn't one or it's for more than the archive being served
+	index []byte
+	empty []byte
+}
+
+func init() {
+	// Not every system knows these
+	mime.AddExtensionType(".webp", "image/webp")
+	mime.AddExtensionType(".pmtiles", "application/octet-stream")
+}
+
+// serve serves the map at path, which is either an output directory or an
+// mbtiles or pmtiles archive, on addr until ctx is done.
+func serve(ctx context.Context, path, addr string) {
+	var s, err = newServer(path)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	defer s.Close()
+
+	var srv = &http.Server{Addr: addr, Handler: s}
+	go func() {
+		<-ctx.Done()
+		var shutdown, cancel = context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		srv.Shutdown(shutdown)
+	}()
+
+	fmt.Printf("Serving %s on http://%s/\n", path, addr)
+	if err = srv.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+		log.Fatal(err)
+	}
+}
+
+func newServer(p string) (*server, error) {
+	var stat, err = os.Stat(p)
+	if err != nil {
+		return nil, err
+	}
+
+	var s = &server{dir: p, archives: make(map[string]tileReader)}
+	var single = !stat.IsDir()
+	if single {
+		// An archive on its own is the only surface, anything else is served from the
+		// directory it's in
+		s.dir = filepath.Dir(p)
+
+		var archive tileReader
+		if archive, err = openTileReader(p); err != nil {
+			return nil, err
+		}
+
+		s.modtime = stat.ModTime()
+
+		// One of the archives mapgen wrote is served as its surface, so the tiles
+		// are where the surface's entities and search results expect them.
+		// Anything else is named after its file
+		var name = strings.TrimSuffix(filepath.Base(p), filepath.Ext(p))
+		var sf = surface{Name: name, Dir: name}
+
+		var surfaces []surface
+		if surfaces, err = readSurfaces(s.dir); err != nil {
+			archive.Close()
+			return nil, err
+		}
+
+		for _, candidate := range surfaces {
+			if archivePath(s.dir, candidate, strings.TrimPrefix(filepath.Ext(p), ".")) != filepath.Clean(p) {
+				continue
+			}
+
+			sf = candidate
+			if s.region, err = readRegion(s.dir); err != nil {
+				archive.Close()
+				return nil, err
+			}
+
+			break
+		}
+
+		s.archives[sf.Dir] = archive
+		s.surfaces = []surface{sf}
+	} else {
+		if s.surfaces, err = readSurfaces(p); err != nil {
+			return nil, err
+		}
+
+		if s.region, err = readRegion(p); err != nil {
+			return nil, err
+		}
+
+		// Surfaces without loose tiles have them in an archive
+		for _, sf := range s.surfaces {
+			if _, err = os.Stat(filepath.Join(p, "tiles", sf.Dir)); err == nil {
+				continue
+			}
+
+			for _, ext := range []string{"mbtiles", "pmtiles"} {
+				var path = archivePath(p, sf, ext)
+				if stat, err = os.Stat(path); err != nil {
+					continue
+				}
+
+				var archive tileReader
+				if archive, err = openTileReader(path); err != nil {
+					s.Close()
+					return nil, err
+				}
+
+				s.archives[sf.Dir] = archive
+				if stat.ModTime().After(s.modtime) {
+					s.modtime = stat.ModTime()
+				}
+
+				break
+			}
+
+			if s.archives[sf.Dir] == nil {
+				s.Close()
+				return nil, fmt.Errorf("no tiles found for %s in %s", sf.Name, p)
+			}
+		}
+
+		if len(s.surfaces) == 0 {
+			return nil, fmt.Errorf("no tiles found in %s", p)
+		}
+	}
+
+	for _, archive := range s.archives {
+		if s.meta, err = archive.ReadMetadata(); err != nil {
+			s.Close()
+			return nil, err
+		}
+
+		// Archives from before the tile size was recorded are all 1024
+		if s.meta.TileSize == 0 {
+			s.meta.TileSize = 1024
+		}
+	}
+
+	if s.empty, err = readFallback(s.dir, "empty.jpg"); err != nil {
+		return nil, err
+	}
+
+	// Without a viewer next to the archives, generate one that reads tiles from us.
+	// The one mapgen wrote for the whole map has surfaces a single archive doesn't
+	if _, err = os.Stat(filepath.Join(s.dir, "index.html")); single || (os.IsNotExist(err) && len(s.archives) > 0) {
+		var v = newViewer(s.meta.Format, s.meta.TileSize, s.meta.MaxZoom, s.surfaces, s.region)
+		v.findData(s.dir, s.surfaces)
+
+		var buf bytes.Buffer
+		if err = executeViewer(&buf, v); err != nil {
+			s.Close()
+			return nil, err
+		}
+
+		s.index = buf.Bytes()
+		s.modtime = time.Now()
+	}
+
+	return s, nil
+}
+
+// Close closes every archive the server reads tiles from.
+func (s *server) Close() error {
+	var err error
+	for _, archive := range s.archives {
+		if cerr := archive.Close(); err == nil {
+			err = cerr
+		}
+	}
+
+	return err
+}
+
+func openTileReader(path string) (tileReader, error) {
+	switch filepath.Ext(path) {
+	case ".mbtiles":
+		return maptorio.OpenMBTiles(path)
+	case ".pmtiles":
+		return maptorio.OpenPMTiles(path)
+	}
+
+	return nil, fmt.Errorf("%s is not an mbtiles or pmtiles archive", path)
+}
+
+// readFallback reads name out of dir, or the current directory if dir doesn't
+// have it.
+func readFallback(dir, name string) ([]byte, error) {
+	var data, err = ioutil.ReadFile(filepath.Join(dir, name))
+	if os.IsNotExist(err) {
+		return ioutil.ReadFile(name)
+	}
+
+	return data, err
+}
+
+func (s *server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	var name = path.Clean("/" + r.URL.Path)
+	if name == "/" {
+		name = "/index.html"
+	}
+
+	switch {
+	case name == "/index.html" && s.index != nil:
+		serveBytes(w, r, name, s.modtime, s.index)
+	case strings.HasPrefix(name, "/tiles/"):
+		s.serveTile(w, r, name)
+	default:
+		s.serveFile(w, r, name)
+	}
+}
+
+// serveTile serves the tile at a path like /tiles/{surface}/{z}/{x}x{y}.jpg,
+// falling back to the placeholder for tiles that don't exist.
+func (s *server) serveTile(w http.ResponseWriter, r *http.Request, name string) {
+	var parts = strings.Split(strings.TrimPrefix(name, "/tiles/"), "/")
+	if len(parts) != 3 {
+		http.NotFound(w, r)
+		return
+	}
+
+	var archive = s.archives[parts[0]]
+	if archive == nil {
+		if _, err := os.Stat(filepath.Join(s.dir, filepath.FromSlash(name))); os.IsNotExist(err) {
+			serveBytes(w, r, "/empty.jpg", time.Time{}, s.empty)
+			return
+		}
+
+		s.serveFile(w, r, name)
+		return
+	}
+
+	var z, errz = strconv.Atoi(parts[1])
+	var x, y int
+	var _, errxy = fmt.Sscanf(strings.TrimSuffix(parts[2], path.Ext(parts[2])), "%dx%d", &x, &y)
+	if errz != nil || errxy != nil {
+		http.NotFound(w, r)
+		return
+	}
+
+	var data, err = archive.ReadTile(z, x, y)
+	if err == maptorio.ErrNoTile {
+		serveBytes(w, r, "/empty.jpg", time.Time{}, s.empty)
+		return
+	} else if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	serveBytes(w, r, "/tile."+s.meta.Format.Ext(), s.modtime, data)
+}
+
+// serveFile serves name from the map directory.
+func (s *server) serveFile(w http.ResponseWriter, r *http.Request, name string) {
+	var f, err = http.Dir(s.dir).Open(name)
+	if err != nil {
+		http.NotFound(w, r)
+		return
+	}
+	defer f.Close()
+
+	var stat os.FileInfo
+	if stat, err = f.Stat(); err != nil || stat.IsDir() {
+		http.NotFound(w, r)
+		return
+	}
+
+	w.Header().Set("ETag", fmt.Sprintf(`"%x-%x"`, stat.ModTime().UnixNano(), stat.Size()))
+	http.ServeContent(w, r, name, stat.ModTime(), f)
+}
+
+// serveBytes serves data as if it were a file called name, with an ETag
+// derived from its content.
+func serveBytes(w http.ResponseWriter, r *http.Request, name string, modtime time.Time, data []byte) {
+	var sum = sha256.Sum256(data)
+	w.Header().Set("ETag", fmt.Sprintf(`"%x"`, sum[:16]))
+	http.ServeContent(w, r, name, modtime, bytes.NewReader(data))
+}
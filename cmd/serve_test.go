@@ -0,0 +1,342 @@
+package main
+
+import (
+	"bytes"
+	"image"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"testing"
+
+	"github.com/avidal/maptorio"
+)
+
+// inRepo runs the test from the top of the repository, where the viewer
+// template and the placeholder tile are.
+func inRepo(t *testing.T) {
+	var wd, err = os.Getwd()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err = os.Chdir(".."); err != nil {
+		t.Fatal(err)
+	}
+
+	t.Cleanup(func() { os.Chdir(wd) })
+}
+
+// testMap writes a map with three surfaces to a temporary directory and
+// returns it: nauvis with loose tiles, "a b" in an MBTiles archive and
+// vulcanus in a PMTiles archive. Each has a tile at 9/0x0 whose content is
+// the surface's name.
+func testMap(t *testing.T) string {
+	var od = filepath.Join(t.TempDir(), "maptorio-railworld")
+	var surfaces = []surface{{Name: "nauvis", Dir: "nauvis"}, {Name: "a b", Dir: "a_b-2"}, {Name: "vulcanus", Dir: "vulcanus"}}
+
+	writeFile(t, filepath.Join(od, "tiles", "nauvis", "9", "0x0.jpg"), "nauvis")
+	if err := writeSurfaces(od, surfaces); err != nil {
+		t.Fatal(err)
+	}
+
+	var meta = maptorio.Metadata{
+		Name:     "railworld",
+		Format:   maptorio.JPEG(0),
+		TileSize: 512,
+		MinZoom:  3,
+		MaxZoom:  9,
+		Bounds:   image.Rect(-1, 0, 1, 1),
+	}
+
+	var mbtiles, err = maptorio.OpenMBTiles(archivePath(od, surfaces[1], "mbtiles"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err = mbtiles.WriteTile(9, 0, 0, []byte("a b")); err != nil {
+		t.Fatal(err)
+	}
+
+	if err = mbtiles.WriteMetadata(meta); err != nil {
+		t.Fatal(err)
+	}
+
+	if err = mbtiles.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	var src = maptorio.NewDirStore(t.TempDir(), "jpg")
+	if err = src.WriteTile(9, 0, 0, []byte("vulcanus")); err != nil {
+		t.Fatal(err)
+	}
+
+	if err = maptorio.WritePMTiles(archivePath(od, surfaces[2], "pmtiles"), src, meta); err != nil {
+		t.Fatal(err)
+	}
+
+	return od
+}
+
+func newTestServer(t *testing.T, path string) *server {
+	var s, err = newServer(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	t.Cleanup(func() { s.Close() })
+	return s
+}
+
+// get requests path from s with the headers in header, which are pairs of
+// names and values.
+func get(s *server, path string, header ...string) *httptest.ResponseRecorder {
+	var r = httptest.NewRequest("GET", path, nil)
+	for i := 0; i+1 < len(header); i += 2 {
+		r.Header.Set(header[i], header[i+1])
+	}
+
+	var w = httptest.NewRecorder()
+	s.ServeHTTP(w, r)
+	return w
+}
+
+func TestServe(t *testing.T) {
+	inRepo(t)
+
+	var od = testMap(t)
+	writeFile(t, filepath.Join(od, "index.html"), "<title>railworld</title>")
+
+	var empty, err = ioutil.ReadFile("empty.jpg")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var s = newTestServer(t, od)
+
+	var tests = []struct {
+		path   string
+		status int
+		typ    string
+		body   []byte
+	}{
+		{"/", http.StatusOK, "text/html; charset=utf-8", []byte("<title>railworld</title>")},
+		{"/surfaces.json", http.StatusOK, "application/json", nil},
+		{"/tiles/nauvis/9/0x0.jpg", http.StatusOK, "image/jpeg", []byte("nauvis")},
+		{"/tiles/a_b-2/9/0x0.jpg", http.StatusOK, "image/jpeg", []byte("a b")},
+		{"/tiles/vulcanus/9/0x0.jpg", http.StatusOK, "image/jpeg", []byte("vulcanus")},
+
+		// Tiles that weren't rendered are the placeholder, wherever they'd be
+		{"/tiles/nauvis/9/5x5.jpg", http.StatusOK, "image/jpeg", empty},
+		{"/tiles/a_b-2/9/-1x0.jpg", http.StatusOK, "image/jpeg", empty},
+		{"/tiles/vulcanus/4/0x0.jpg", http.StatusOK, "image/jpeg", empty},
+		{"/tiles/elsewhere/9/0x0.jpg", http.StatusOK, "image/jpeg", empty},
+
+		{"/tiles/vulcanus/z/0x0.jpg", http.StatusNotFound, "", nil},
+		{"/tiles/vulcanus/9/0.jpg", http.StatusNotFound, "", nil},
+		{"/tiles/vulcanus/9/0x0.jpg/more", http.StatusNotFound, "", nil},
+		{"/tiles", http.StatusNotFound, "", nil},
+		{"/missing.json", http.StatusNotFound, "", nil},
+
+		// Nothing outside the map's directory is served
+		{"/../surfaces.json", http.StatusOK, "application/json", nil},
+		{"/../maptorio-railworld/surfaces.json", http.StatusNotFound, "", nil},
+		{"/../../index.html", http.StatusOK, "text/html; charset=utf-8", []byte("<title>railworld</title>")},
+	}
+
+	for _, tt := range tests {
+		var w = get(s, tt.path)
+		if w.Code != tt.status {
+			t.Errorf("%s: status %d, want %d", tt.path, w.Code, tt.status)
+			continue
+		}
+
+		if tt.typ != "" && w.Header().Get("Content-Type") != tt.typ {
+			t.Errorf("%s: content type %q, want %q", tt.path, w.Header().Get("Content-Type"), tt.typ)
+		}
+
+		if tt.body != nil && !bytes.Equal(w.Body.Bytes(), tt.body) {
+			t.Errorf("%s: body %q, want %q", tt.path, w.Body.Bytes(), tt.body)
+		}
+	}
+}
+
+func TestServeCaching(t *testing.T) {
+	inRepo(t)
+
+	var s = newTestServer(t, testMap(t))
+
+	// Files on disk, tiles in archives, the generated viewer and the
+	// placeholder are all cached the same way
+	for _, path := range []string{"/surfaces.json", "/tiles/nauvis/9/0x0.jpg", "/tiles/a_b-2/9/0x0.jpg", "/tiles/vulcanus/9/0x0.jpg", "/", "/tiles/nauvis/9/5x5.jpg"} {
+		var w = get(s, path)
+		if w.Code != http.StatusOK {
+			t.Errorf("%s: status %d", path, w.Code)
+			continue
+		}
+
+		var etag = w.Header().Get("ETag")
+		if !strings.HasPrefix(etag, `"`) || !strings.HasSuffix(etag, `"`) || len(etag) < 3 {
+			t.Errorf("%s: ETag %q", path, etag)
+		}
+
+		if w = get(s, path, "If-None-Match", etag); w.Code != http.StatusNotModified {
+			t.Errorf("%s: status %d with a matching ETag, want 304", path, w.Code)
+		}
+
+		if w = get(s, path, "If-None-Match", `"stale"`); w.Code != http.StatusOK {
+			t.Errorf("%s: status %d with a stale ETag, want 200", path, w.Code)
+		}
+
+		// The placeholder has no modification time to go by
+		var modified = w.Header().Get("Last-Modified")
+		if path == "/tiles/nauvis/9/5x5.jpg" {
+			if modified != "" {
+				t.Errorf("%s: Last-Modified %q for the placeholder", path, modified)
+			}
+
+			continue
+		}
+
+		if modified == "" {
+			t.Errorf("%s: no Last-Modified", path)
+			continue
+		}
+
+		if w = get(s, path, "If-Modified-Since", modified); w.Code != http.StatusNotModified {
+			t.Errorf("%s: status %d when unmodified since %s, want 304", path, w.Code, modified)
+		}
+
+		if w = get(s, path, "If-Modified-Since", "Mon, 02 Jan 2006 15:04:05 GMT"); w.Code != http.StatusOK {
+			t.Errorf("%s: status %d when modified since 2006, want 200", path, w.Code)
+		}
+	}
+
+	// Different tiles from the same archive can't share an ETag
+	if a, b := get(s, "/tiles/a_b-2/9/0x0.jpg"), get(s, "/tiles/vulcanus/9/0x0.jpg"); a.Header().Get("ETag") == b.Header().Get("ETag") {
+		t.Errorf("tiles with different content share the ETag %s", a.Header().Get("ETag"))
+	}
+}
+
+func TestServeViewer(t *testing.T) {
+	inRepo(t)
+
+	var od = testMap(t)
+	var s = newTestServer(t, od)
+
+	// There's no index.html, so one is made for all three surfaces
+	var w = get(s, "/")
+	if w.Code != http.StatusOK || w.Header().Get("Content-Type") != "text/html; charset=utf-8" {
+		t.Fatalf("status %d, content type %q", w.Code, w.Header().Get("Content-Type"))
+	}
+
+	for _, dir := range []string{"nauvis", "a_b-2", "vulcanus"} {
+		if !strings.Contains(w.Body.String(), `"dir":"`+dir+`"`) {
+			t.Errorf("the viewer doesn't have the surface %s", dir)
+		}
+	}
+
+	if !regexp.MustCompile(`tileSize:\s*512\b`).MatchString(w.Body.String()) {
+		t.Error("the viewer isn't for 512 pixel tiles")
+	}
+}
+
+func TestServeArchive(t *testing.T) {
+	inRepo(t)
+
+	var od = testMap(t)
+
+	// The index.html mapgen writes is for every surface, each archive is
+	// served as just its own
+	writeFile(t, filepath.Join(od, "index.html"), "<title>railworld</title>")
+	if err := writeRegion(od, &region{Name: "station", Right: 1, Bottom: 1}); err != nil {
+		t.Fatal(err)
+	}
+
+	var archives = []struct {
+		surface surface
+		ext     string
+	}{
+		{surface{Name: "a b", Dir: "a_b-2"}, "mbtiles"},
+		{surface{Name: "vulcanus", Dir: "vulcanus"}, "pmtiles"},
+	}
+
+	for _, a := range archives {
+		t.Run(a.ext, func(t *testing.T) {
+			var s = newTestServer(t, archivePath(od, a.surface, a.ext))
+			if len(s.surfaces) != 1 || s.surfaces[0] != a.surface {
+				t.Fatalf("serving surfaces %v, want %v", s.surfaces, a.surface)
+			}
+
+			if s.region == nil {
+				t.Error("the map's region wasn't read")
+			}
+
+			var w = get(s, "/")
+			if w.Code != http.StatusOK || strings.Contains(w.Body.String(), "<title>railworld</title>") {
+				t.Fatalf("status %d serving the map's index.html instead of a viewer for the archive", w.Code)
+			}
+
+			if !strings.Contains(w.Body.String(), `"dir":"`+a.surface.Dir+`"`) || strings.Contains(w.Body.String(), `"dir":"nauvis"`) {
+				t.Errorf("the viewer isn't for just %s", a.surface.Dir)
+			}
+
+			if w = get(s, "/tiles/"+a.surface.Dir+"/9/0x0.jpg"); w.Code != http.StatusOK || w.Body.String() != a.surface.Name {
+				t.Errorf("status %d reading tile %q, want %q", w.Code, w.Body.String(), a.surface.Name)
+			}
+
+			// Everything else still comes from the map's directory
+			if w = get(s, "/surfaces.json"); w.Code != http.StatusOK {
+				t.Errorf("status %d reading surfaces.json", w.Code)
+			}
+		})
+	}
+
+	// An archive on its own is named after its file
+	var dir = t.TempDir()
+	var path = filepath.Join(dir, "railworld.mbtiles")
+	var data, err = ioutil.ReadFile(archivePath(od, archives[0].surface, "mbtiles"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	writeFile(t, path, string(data))
+
+	var s = newTestServer(t, path)
+	if len(s.surfaces) != 1 || s.surfaces[0] != (surface{Name: "railworld", Dir: "railworld"}) || s.region != nil {
+		t.Fatalf("serving surfaces %v in region %v, want railworld and no region", s.surfaces, s.region)
+	}
+
+	if w := get(s, "/tiles/railworld/9/0x0.jpg"); w.Code != http.StatusOK || w.Body.String() != "a b" {
+		t.Errorf("status %d reading tile %q, want %q", w.Code, w.Body.String(), "a b")
+	}
+}
+
+func TestNewServerErrors(t *testing.T) {
+	inRepo(t)
+
+	// A surface with neither loose tiles nor an archive
+	var od = testMap(t)
+	if err := os.Remove(archivePath(od, surface{Name: "vulcanus", Dir: "vulcanus"}, "pmtiles")); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := newServer(od); err == nil || !strings.Contains(err.Error(), "no tiles found for vulcanus") {
+		t.Errorf("got %v for a surface without tiles", err)
+	}
+
+	if _, err := newServer(t.TempDir()); err == nil || !strings.Contains(err.Error(), "no tiles found") {
+		t.Errorf("got %v for an empty directory", err)
+	}
+
+	if _, err := newServer(filepath.Join(od, "surfaces.json")); err == nil || !strings.Contains(err.Error(), "not an mbtiles or pmtiles archive") {
+		t.Errorf("got %v for a file that isn't an archive", err)
+	}
+
+	if _, err := newServer(filepath.Join(od, "missing.mbtiles")); !os.IsNotExist(err) {
+		t.Errorf("got %v for a missing archive", err)
+	}
+}
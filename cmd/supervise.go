@@ -0,0 +1,174 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"time"
+)
+
+// timeouts limit how long the game gets for each part of a render. A zero
+// timeout is no limit.
+type timeouts struct {
+	// Stall is how long the game can go without writing anything
+	Stall time.Duration
+
+	// Load is how long the game has to load the save and write the manifest,
+	// and Screenshots how long it has to take them after that
+	Load        time.Duration
+	Screenshots time.Duration
+}
+
+// gameLogs are where the game writes about what it's doing: its own log in
+// its write-data directory, and whatever it prints, which is captured to a
+// file in the workspace.
+type gameLogs struct {
+	Current string
+	Output  string
+}
+
+func newGameLogs(td string) gameLogs {
+	return gameLogs{
+		Current: filepath.Join(td, "data", "factorio-current.log"),
+		Output:  filepath.Join(td, "factorio-output.log"),
+	}
+}
+
+// failure is a problem the game is known to run into, recognised by a line
+// in its logs.
+type failure struct {
+	pattern   *regexp.Regexp
+	diagnosis string
+}
+
+// failures are in order of priority, since one problem often leads to
+// others being logged after it. The patterns follow the game's own messages
+// closely, so the names of mods or files that happen to contain words like
+// missing don't match.
+var failures = []failure{
+	{
+		regexp.MustCompile(`(?i)\bmap version \S+ cannot be loaded\b|\bis higher than the game version\b`),
+		"the save was made with a newer version of factorio, install that version or newer and set binary-path to it",
+	},
+	{
+		regexp.MustCompile(`(?i)\bfailed to load mods\b|\bmod "?[\w-]+"? (\(\S+\) )?(is missing|not found)\b|\bdependency .+ (is )?not satisfied\b`),
+		"the save needs mods that couldn't be loaded, check mod-directory and enabled-mods",
+	},
+	{
+		regexp.MustCompile(`(?i)\bout of video memory\b|\bnot enough video memory\b|\bdevice lost\b|\bfailed to allocate (a )?(texture|render target|video memory)\b`),
+		"the game ran out of video memory, try a smaller screenshot-resolution",
+	},
+	{
+		regexp.MustCompile(`(?i)\berror while running event maptorio::|__maptorio__/control\.lua:\d+:`),
+		"the maptorio mod hit a script error while taking screenshots",
+	},
+	{
+		regexp.MustCompile(`(?i)\bfailed to load (the )?(map|save|level)\b|\bcannot open map\b|\berror loading map\b|\bcould not load (the )?(map|save|level)\b|\b(map|save|level)( file)? (is )?corrupt(ed)?\b`),
+		"the game couldn't load the save, make sure it opens in the game itself",
+	},
+}
+
+// diagnose looks through the game's logs for the most likely known failure,
+// returning the explanation and the first line it was found on.
+func diagnose(logs gameLogs) (string, string) {
+	var lines []string
+	for _, path := range []string{logs.Current, logs.Output} {
+		var data, err = ioutil.ReadFile(path)
+		if err != nil {
+			continue
+		}
+
+		lines = append(lines, strings.Split(string(data), "\n")...)
+	}
+
+	for _, fail := range failures {
+		for _, line := range lines {
+			if fail.pattern.MatchString(line) {
+				return fail.diagnosis, line
+			}
+		}
+	}
+
+	return "", ""
+}
+
+// supervise runs the game until the mod has written every screenshot, watching
+// it with watch. It returns an error if the game exits early, stalls or runs
+// out of time, with a diagnosis from the game's logs when there is one. The
+// game is stopped either way.
+func supervise(ctx context.Context, cmd *exec.Cmd, watch *progress, limits timeouts, logs gameLogs) error {
+	var out, err = os.Create(logs.Output)
+	if err != nil {
+		return err
+	}
+	defer out.Close()
+
+	cmd.Stdout = out
+	cmd.Stderr = out
+
+	if err = cmd.Start(); err != nil {
+		return err
+	}
+
+	// The mod writes a manifest of the screenshots it's going to take, then progress markers as
+	// it asks for them. Once every screenshot in the manifest has been written we can kill the process
+	var wctx, cancel = context.WithCancel(ctx)
+	defer cancel()
+
+	var sig = make(chan error, 1)
+	go func() {
+		sig <- watch.Wait(wctx, limits)
+	}()
+
+	// If the game quits before every screenshot is written something went wrong. That includes it
+	// exiting cleanly, which is what happens when someone closes the window
+	var pchan = make(chan error, 1)
+	go func() {
+		pchan <- cmd.Wait()
+	}()
+
+	select {
+	case err = <-pchan:
+		cancel()
+		<-sig
+		watch.Close()
+
+		if err == nil {
+			err = fmt.Errorf("factorio exited before all of the screenshots were written")
+		} else {
+			err = fmt.Errorf("factorio exited abnormally: %s", err)
+		}
+
+		return diagnosed(err, logs)
+
+	case err = <-sig:
+	}
+
+	cmd.Process.Kill()
+	<-pchan
+	watch.Close()
+
+	if err != nil && ctx.Err() == nil {
+		return diagnosed(err, logs)
+	}
+
+	return err
+}
+
+// diagnosed adds the diagnosis from the game's logs to err, along with where
+// to find them.
+func diagnosed(err error, logs gameLogs) error {
+	var msg = err.Error()
+
+	if diagnosis, line := diagnose(logs); diagnosis != "" {
+		msg += "\n\nProbably " + diagnosis + ", the game said:\n  " + strings.TrimSpace(line)
+	}
+
+	msg += "\n\nThe game's log is at " + logs.Current + "\nand its output is at " + logs.Output
+	return fmt.Errorf("%s", msg)
+}
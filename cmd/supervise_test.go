@@ -0,0 +1,106 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestDiagnose(t *testing.T) {
+	var (
+		newer   = "the save was made with a newer version of factorio"
+		mods    = "the save needs mods that couldn't be loaded"
+		vram    = "the game ran out of video memory"
+		script  = "the maptorio mod hit a script error"
+		load    = "the game couldn't load the save"
+		nothing = ""
+	)
+
+	var tests = []struct {
+		name    string
+		current []string
+		output  []string
+		want    string
+		line    string
+	}{
+		{
+			name:    "newer save",
+			current: []string{"   1.234 Loading map /tmp/railworld.zip: 1234567 bytes.", "   1.300 Map version 2.0.60-0 cannot be loaded because it is higher than the game version (1.1.110-0)."},
+			want:    newer,
+		},
+		{
+			name:    "missing mod",
+			current: []string{"   0.900 Error Util.cpp:83: Mod Bottleneck (0.11.7) is missing"},
+			want:    mods,
+		},
+		{
+			name:    "failed mods",
+			current: []string{`   0.900 Error Util.cpp:83: Failed to load mods: __Bottleneck__/data.lua:1: attempt to index a nil value`},
+			want:    mods,
+		},
+		{
+			name:    "dependency",
+			current: []string{`   0.900 Error ModManager.cpp:1024: Mod "Krastorio2" dependency "flib >= 0.12.0" is not satisfied`},
+			want:    mods,
+		},
+		{
+			name:   "video memory",
+			output: []string{"Out of video memory while allocating a texture"},
+			want:   vram,
+		},
+		{
+			name:    "script error",
+			current: []string{"   5.000 Error MainLoop.cpp:1285: Error while running event maptorio::on_tick (ID 0)", "__maptorio__/control.lua:120: attempt to index a nil value"},
+			want:    script,
+		},
+		{
+			name:    "corrupt save",
+			current: []string{"   1.300 Error loading map: Map file is corrupted"},
+			want:    load,
+		},
+		{
+			name: "the highest priority wins over the earliest",
+			current: []string{
+				"   1.300 Failed to load the save: unexpected end of file",
+				"   1.400 Map version 2.0.60-0 cannot be loaded because it is higher than the game version (1.1.110-0).",
+			},
+			want: newer,
+			line: "Map version",
+		},
+		{
+			name:    "logs are searched together",
+			current: []string{"   1.300 Failed to load the save: unexpected end of file"},
+			output:  []string{"Mod Bottleneck is missing"},
+			want:    mods,
+		},
+		{
+			name: "mod names and other messages aren't failures",
+			current: []string{
+				"   0.500 Loading mod missing-recipes-fix 1.0.0 (data.lua)",
+				"   0.600 Loading mod corrupted-biters 2.1.0 (data.lua)",
+				"   0.700 Could not load font file, falling back to the default",
+				"   0.800 Failed to allocate an audio channel",
+				"   0.900 Checksum for script __maptorio__/control.lua: 1234567",
+			},
+			want: nothing,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var logs = newGameLogs(t.TempDir())
+			writeFile(t, logs.Current, strings.Join(tt.current, "\n"))
+			writeFile(t, logs.Output, strings.Join(tt.output, "\n"))
+
+			var diagnosis, line = diagnose(logs)
+			if tt.want == "" && diagnosis != "" {
+				t.Fatalf("diagnosed %q from %q", diagnosis, line)
+			} else if !strings.HasPrefix(diagnosis, tt.want) {
+				t.Fatalf("diagnosed %q from %q, want %q", diagnosis, line, tt.want)
+			}
+
+			if !strings.Contains(line, tt.line) {
+				t.Errorf("found on %q, want the line with %q", line, tt.line)
+			}
+		})
+	}
+}
@@ -0,0 +1,81 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+)
+
+// surface is one of the game's surfaces, eg: nauvis or a factory interior.
+// Each is rendered into its own tile tree, tiles/{dir}.
+type surface struct {
+	Name string `json:"name"`
+	Dir  string `json:"dir"`
+}
+
+// writeSurfaces records the surfaces rendered into the map in od.
+func writeSurfaces(od string, surfaces []surface) error {
+	var data, err = json.MarshalIndent(surfaces, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	return ioutil.WriteFile(filepath.Join(od, "surfaces.json"), data, 0644)
+}
+
+// readSurfaces returns the surfaces of the map in od. Without a surfaces.json
+// every directory in od/tiles is taken to be a surface named after it.
+func readSurfaces(od string) ([]surface, error) {
+	var surfaces []surface
+
+	var data, err = ioutil.ReadFile(filepath.Join(od, "surfaces.json"))
+	if err == nil {
+		return surfaces, json.Unmarshal(data, &surfaces)
+	} else if !os.IsNotExist(err) {
+		return nil, err
+	}
+
+	var entries []os.FileInfo
+	if entries, err = ioutil.ReadDir(filepath.Join(od, "tiles")); err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+
+	for _, entry := range entries {
+		// Maps from before there were surfaces have their zoom levels straight in tiles
+		if _, err = strconv.Atoi(entry.Name()); err == nil {
+			return nil, fmt.Errorf("%s was made by an older maptorio, render the save again", od)
+		}
+
+		if entry.IsDir() {
+			surfaces = append(surfaces, surface{Name: entry.Name(), Dir: entry.Name()})
+		}
+	}
+
+	return surfaces, nil
+}
+
+// defaultSurface returns the surface the viewer starts on: nauvis if the map
+// has it, otherwise the first one.
+func defaultSurface(surfaces []surface) string {
+	if len(surfaces) == 0 {
+		return ""
+	}
+
+	for _, s := range surfaces {
+		if s.Name == "nauvis" {
+			return s.Dir
+		}
+	}
+
+	var dirs = make([]string, 0, len(surfaces))
+	for _, s := range surfaces {
+		dirs = append(dirs, s.Dir)
+	}
+
+	sort.Strings(dirs)
+	return dirs[0]
+}
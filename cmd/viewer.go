@@ -0,0 +1,125 @@
+package main
+
+import (
+	"html/template"
+	"io"
+	"os"
+	"path/filepath"
+
+	"github.com/avidal/maptorio"
+)
+
+// viewer is everything the index.html template needs to show a map.
+type viewer struct {
+	Ext      string
+	TileSize int
+
+	// MaxNativeZoom is the zoom level of the screenshots, and MinNativeZoom the
+	// lowest level the viewer loads tiles for before scaling them down instead
+	MinNativeZoom int
+	MaxNativeZoom int
+
+	// Surfaces are the maps the viewer can switch between, starting on Default
+	Surfaces []viewerSurface
+	Default  string
+
+	// Overlays is set when any surface has entities to show over the map, and
+	// Search when there's a search index next to index.html
+	Overlays bool
+	Search   bool
+
+	// Region is the part of the map that was rendered, which the viewer
+	// centers on and keeps to, or nil for the whole map
+	Region *region
+
+	// PMTiles is set when each surface's tiles are read from its pmtiles
+	// archive, otherwise they're read from the tiles directory
+	PMTiles    bool
+	ZoomOffset int
+}
+
+// viewerSurface is a surface as the viewer's script sees it.
+type viewerSurface struct {
+	Name    string `json:"name"`
+	Dir     string `json:"dir"`
+	PMTiles string `json:"pmtiles,omitempty"`
+
+	// Entities is the GeoJSON of the surface's overlays, if it has any
+	Entities string `json:"entities,omitempty"`
+}
+
+func newViewer(f maptorio.Format, tileSize, baseZoom int, surfaces []surface, r *region) viewer {
+	var v = viewer{
+		Ext:           f.Ext(),
+		TileSize:      tileSize,
+		MinNativeZoom: baseZoom - 6,
+		MaxNativeZoom: baseZoom,
+		Default:       defaultSurface(surfaces),
+		Region:        r,
+		ZoomOffset:    maptorio.PMTilesZoomOffset,
+	}
+
+	for _, s := range surfaces {
+		v.Surfaces = append(v.Surfaces, viewerSurface{Name: s.Name, Dir: s.Dir})
+	}
+
+	return v
+}
+
+// writeViewer renders the index.html template into path for a map of
+// surfaces generated with config, rendered for the region r if it isn't nil.
+func writeViewer(config iniconfig, surfaces []surface, r *region, path string) error {
+	var out, err = os.Create(path)
+	if err != nil {
+		return err
+	}
+
+	var v = newViewer(config.format, config.Resolution, config.baseZoom(), surfaces, r)
+
+	// A pmtiles map reads its tiles out of the archives next to index.html
+	if config.TileArchive == "pmtiles" {
+		v.PMTiles = true
+		for i, s := range surfaces {
+			v.Surfaces[i].PMTiles = filepath.Base(archivePath(filepath.Dir(path), s, "pmtiles"))
+		}
+	}
+
+	v.findData(filepath.Dir(path), surfaces)
+
+	if err = executeViewer(out, v); err != nil {
+		out.Close()
+		return err
+	}
+
+	return out.Close()
+}
+
+// findData points the viewer at the overlays for each of the surfaces of
+// the map in od that has them, and its search index if there is one.
+func (v *viewer) findData(od string, surfaces []surface) {
+	if _, err := os.Stat(filepath.Join(od, "search.json")); err == nil {
+		v.Search = true
+	}
+
+	for i, s := range surfaces {
+		var path = entitiesPath(od, s)
+		if _, err := os.Stat(path); err != nil {
+			continue
+		}
+
+		if rel, err := filepath.Rel(od, path); err == nil {
+			v.Surfaces[i].Entities = filepath.ToSlash(rel)
+			v.Overlays = true
+		}
+	}
+}
+
+// executeViewer renders the index.html template to w.
+func executeViewer(w io.Writer, v viewer) error {
+	var tmpl, err = template.ParseFiles("index.html")
+	if err != nil {
+		return err
+	}
+
+	return tmpl.Execute(w, v)
+}
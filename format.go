@@ -0,0 +1,96 @@
+package maptorio
+
+import (
+	"fmt"
+	"image"
+	"image/jpeg"
+	"image/png"
+	"io"
+	"strings"
+
+	"github.com/HugoSmits86/nativewebp"
+	"golang.org/x/image/webp"
+)
+
+// Format is an image encoding for tiles.
+type Format interface {
+	// Ext is the file extension used for tiles in this format, without the dot.
+	Ext() string
+
+	// ContentType is the MIME type of tiles in this format.
+	ContentType() string
+
+	Encode(w io.Writer, im image.Image) error
+	Decode(r io.Reader) (image.Image, error)
+}
+
+// ParseFormat returns the Format called name, one of jpeg, png or webp. The
+// quality only applies to jpeg and falls back to the encoder default if 0.
+func ParseFormat(name string, quality int) (Format, error) {
+	switch strings.ToLower(name) {
+	case "jpeg", "jpg":
+		return JPEG(quality), nil
+	case "png":
+		return PNG, nil
+	case "webp":
+		return WebP, nil
+	}
+
+	return nil, fmt.Errorf("unknown tile format %q", name)
+}
+
+// JPEG returns the lossy JPEG format at the given quality, from 1 to 100.
+func JPEG(quality int) Format {
+	if quality == 0 {
+		quality = jpeg.DefaultQuality
+	}
+
+	return jpegFormat{quality}
+}
+
+// PNG is the lossless PNG format.
+var PNG Format = pngFormat{}
+
+// WebP is the lossless WebP format.
+var WebP Format = webpFormat{}
+
+type jpegFormat struct {
+	quality int
+}
+
+func (f jpegFormat) Ext() string         { return "jpg" }
+func (f jpegFormat) ContentType() string { return "image/jpeg" }
+
+func (f jpegFormat) Encode(w io.Writer, im image.Image) error {
+	return jpeg.Encode(w, im, &jpeg.Options{Quality: f.quality})
+}
+
+func (f jpegFormat) Decode(r io.Reader) (image.Image, error) {
+	return jpeg.Decode(r)
+}
+
+type pngFormat struct{}
+
+func (f pngFormat) Ext() string         { return "png" }
+func (f pngFormat) ContentType() string { return "image/png" }
+
+func (f pngFormat) Encode(w io.Writer, im image.Image) error {
+	return png.Encode(w, im)
+}
+
+func (f pngFormat) Decode(r io.Reader) (image.Image, error) {
+	return png.Decode(r)
+}
+
+type webpFormat struct{}
+
+func (f webpFormat) Ext() string         { return "webp" }
+func (f webpFormat) ContentType() string { return "image/webp" }
+
+func (f webpFormat) Encode(w io.Writer, im image.Image) error {
+	return nativewebp.Encode(w, im, nil)
+}
+
+func (f webpFormat) Decode(r io.Reader) (image.Image, error) {
+	return webp.Decode(r)
+}
@@ -0,0 +1,115 @@
+package maptorio
+
+import (
+	"bytes"
+	"image"
+	"image/color"
+	"testing"
+)
+
+// quadrants returns a 16x16 image with a different colour in each quarter.
+func quadrants() image.Image {
+	var im = image.NewRGBA(image.Rect(0, 0, 16, 16))
+	var colors = []color.RGBA{{255, 0, 0, 255}, {0, 255, 0, 255}, {0, 0, 255, 255}, {255, 255, 255, 255}}
+	for x := 0; x < 16; x++ {
+		for y := 0; y < 16; y++ {
+			im.SetRGBA(x, y, colors[x/8+2*(y/8)])
+		}
+	}
+
+	return im
+}
+
+// assertSimilar checks every pixel of got is within tolerance of want.
+func assertSimilar(t *testing.T, got, want image.Image, tolerance int) {
+	if got.Bounds() != want.Bounds() {
+		t.Fatalf("decoded a %v image, want %v", got.Bounds(), want.Bounds())
+	}
+
+	var diff = func(a, b uint32) int {
+		var d = int(a>>8) - int(b>>8)
+		if d < 0 {
+			return -d
+		}
+
+		return d
+	}
+
+	var b = want.Bounds()
+	for x := b.Min.X; x < b.Max.X; x++ {
+		for y := b.Min.Y; y < b.Max.Y; y++ {
+			var r1, g1, b1, _ = got.At(x, y).RGBA()
+			var r2, g2, b2, _ = want.At(x, y).RGBA()
+			if diff(r1, r2) > tolerance || diff(g1, g2) > tolerance || diff(b1, b2) > tolerance {
+				t.Fatalf("pixel %d, %d is %v, want %v", x, y, got.At(x, y), want.At(x, y))
+			}
+		}
+	}
+}
+
+func TestFormatRoundTrip(t *testing.T) {
+	var tests = []struct {
+		name        string
+		ext         string
+		contentType string
+		tolerance   int
+	}{
+		{"jpeg", "jpg", "image/jpeg", 48},
+		{"JPG", "jpg", "image/jpeg", 48},
+		{"png", "png", "image/png", 0},
+		{"WebP", "webp", "image/webp", 0},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var f, err = ParseFormat(tt.name, 0)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if f.Ext() != tt.ext || f.ContentType() != tt.contentType {
+				t.Errorf("format is .%s and %s, want .%s and %s", f.Ext(), f.ContentType(), tt.ext, tt.contentType)
+			}
+
+			var buf = new(bytes.Buffer)
+			if err = f.Encode(buf, quadrants()); err != nil {
+				t.Fatal(err)
+			}
+
+			var im image.Image
+			if im, err = f.Decode(bytes.NewReader(buf.Bytes())); err != nil {
+				t.Fatal(err)
+			}
+
+			assertSimilar(t, im, quadrants(), tt.tolerance)
+
+			if _, err = f.Decode(bytes.NewReader([]byte("not an image"))); err == nil {
+				t.Error("decoded something that isn't an image")
+			}
+		})
+	}
+}
+
+func TestJPEGQuality(t *testing.T) {
+	var sizes []int
+	for _, quality := range []int{10, 95} {
+		var buf = new(bytes.Buffer)
+		if err := JPEG(quality).Encode(buf, quadrants()); err != nil {
+			t.Fatal(err)
+		}
+
+		sizes = append(sizes, buf.Len())
+	}
+
+	if sizes[0] >= sizes[1] {
+		t.Errorf("quality 10 is %d bytes and quality 95 is %d, want it smaller", sizes[0], sizes[1])
+	}
+}
+
+func TestParseFormatUnknown(t *testing.T) {
+	for _, name := range []string{"", "gif", "jpeg2000", "web p", ".png"} {
+		if f, err := ParseFormat(name, 0); err == nil {
+			t.Errorf("ParseFormat(%q) = %s, want an error", name, f.Ext())
+		}
+	}
+}
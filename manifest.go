@@ -0,0 +1,218 @@
+package maptorio
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+)
+
+// manifest records the content hash of every source tile, keyed by "{x}x{y}",
+// as of the last successful render.
+type manifest struct {
+	Zoom  int               `json:"zoom"`
+	Tiles map[string]string `json:"tiles"`
+}
+
+// loadManifest reads the manifest at path. A missing manifest is returned as
+// nil without an error.
+func loadManifest(path string) (*manifest, error) {
+	var data, err = ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+
+	var m manifest
+	if err = json.Unmarshal(data, &m); err != nil {
+		return nil, fmt.Errorf("error reading manifest %s: %s", path, err)
+	}
+
+	return &m, nil
+}
+
+// save writes the manifest to path, replacing any existing one in one step.
+func (m manifest) save(path string) error {
+	var data, err = json.MarshalIndent(m, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	if err = os.MkdirAll(filepath.Dir(path), os.ModePerm); err != nil {
+		return err
+	}
+
+	var tmp = path + ".tmp"
+	if err = ioutil.WriteFile(tmp, data, 0644); err != nil {
+		return err
+	}
+
+	return os.Rename(tmp, path)
+}
+
+// changedTiles hashes every source tile and compares them against the
+// renderer's manifest. It returns the source tiles that were added, changed or
+// removed since the manifest was written, or nil if there is no usable
+// manifest, along with the manifest describing the current source tiles.
+func (r *Renderer) changedTiles() (map[point]bool, manifest, error) {
+	var current = manifest{Zoom: r.maxZoom, Tiles: map[string]string{}}
+
+	var tiles, err = r.store.Tiles(r.maxZoom)
+	if err != nil {
+		return nil, current, err
+	}
+
+	for _, t := range tiles {
+		var data []byte
+		if data, err = r.store.ReadTile(r.maxZoom, t.X, t.Y); err != nil {
+			return nil, current, err
+		}
+
+		var sum = sha256.Sum256(data)
+		current.Tiles[fmt.Sprintf("%dx%d", t.X, t.Y)] = hex.EncodeToString(sum[:])
+	}
+
+	var previous *manifest
+	if previous, err = loadManifest(r.manifest); err != nil {
+		return nil, current, err
+	}
+
+	// Without a manifest from the same zoom level we can't tell what changed
+	if previous == nil || previous.Zoom != r.maxZoom {
+		return nil, current, nil
+	}
+
+	var dirty = map[point]bool{}
+	for key, sum := range current.Tiles {
+		if previous.Tiles[key] != sum {
+			dirty[parseKey(key)] = true
+		}
+	}
+
+	for key := range previous.Tiles {
+		if _, ok := current.Tiles[key]; !ok {
+			dirty[parseKey(key)] = true
+		}
+	}
+
+	return dirty, current, nil
+}
+
+// digest returns a hash of every source tile in the manifest, which tells
+// whether two renders were building from the same source tiles.
+func (m manifest) digest() string {
+	var keys = make([]string, 0, len(m.Tiles))
+	for key := range m.Tiles {
+		keys = append(keys, key)
+	}
+
+	sort.Strings(keys)
+
+	var h = sha256.New()
+	fmt.Fprintf(h, "%d\n", m.Zoom)
+	for _, key := range keys {
+		fmt.Fprintf(h, "%s %s\n", key, m.Tiles[key])
+	}
+
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+// progress records the tiles a render has built so far, keyed by
+// "{z}/{x}x{y}", along with the digest of the source tiles they were built
+// from. It's kept next to the manifest until the render finishes, so one that
+// was interrupted can be resumed without building those tiles again.
+type progress struct {
+	Sources string          `json:"sources"`
+	Tiles   map[string]bool `json:"tiles"`
+
+	mu sync.Mutex
+}
+
+func newProgress(m manifest) *progress {
+	return &progress{Sources: m.digest(), Tiles: map[string]bool{}}
+}
+
+// loadProgress reads the progress at path of a render that was building from
+// the source tiles in m. Progress that's missing, or that was made from other
+// source tiles, is returned empty.
+func loadProgress(path string, m manifest) (*progress, error) {
+	var p = newProgress(m)
+	var data, err = ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return p, nil
+	} else if err != nil {
+		return nil, err
+	}
+
+	var previous progress
+	if err = json.Unmarshal(data, &previous); err != nil {
+		return nil, fmt.Errorf("error reading render progress %s: %s", path, err)
+	}
+
+	if previous.Sources == p.Sources && previous.Tiles != nil {
+		p.Tiles = previous.Tiles
+	}
+
+	return p, nil
+}
+
+func progressKey(z, x, y int) string {
+	return fmt.Sprintf("%d/%dx%d", z, x, y)
+}
+
+// done returns whether tile x, y at zoom z has been built.
+func (p *progress) done(z, x, y int) bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.Tiles[progressKey(z, x, y)]
+}
+
+// add records that tile x, y at zoom z has been built.
+func (p *progress) add(z, x, y int) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.Tiles[progressKey(z, x, y)] = true
+}
+
+// save writes the progress to path, replacing any existing one in one step.
+func (p *progress) save(path string) error {
+	p.mu.Lock()
+	var data, err = json.Marshal(p)
+	p.mu.Unlock()
+	if err != nil {
+		return err
+	}
+
+	if err = os.MkdirAll(filepath.Dir(path), os.ModePerm); err != nil {
+		return err
+	}
+
+	var tmp = path + ".tmp"
+	if err = ioutil.WriteFile(tmp, data, 0644); err != nil {
+		return err
+	}
+
+	return os.Rename(tmp, path)
+}
+
+// parents returns the tiles one zoom level down that contain the given tiles.
+func parents(tiles map[point]bool) map[point]bool {
+	var out = make(map[point]bool, len(tiles))
+	for t := range tiles {
+		out[point{half(t.x), half(t.y)}] = true
+	}
+
+	return out
+}
+
+func parseKey(key string) point {
+	var p point
+	fmt.Sscanf(key, "%dx%d", &p.x, &p.y)
+	return p
+}
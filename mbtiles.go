@@ -0,0 +1,259 @@
+package maptorio
+
+import (
+	"database/sql"
+	"fmt"
+	"image"
+	"math"
+	"strconv"
+
+	_ "github.com/mattn/go-sqlite3"
+)
+
+// Metadata describes a finished tile pyramid for archive formats that record
+// it alongside the tiles.
+type Metadata struct {
+	// Name is a human readable name for the map, usually the save name.
+	Name     string
+	Format   Format
+	TileSize int
+	MinZoom  int
+	MaxZoom  int
+
+	// Bounds is the area covered by the tiles at MaxZoom, in tile coordinates.
+	Bounds image.Rectangle
+}
+
+// MBTilesZoomOffset is added to every zoom level when tiles are stored in an
+// MBTiles archive. Like PMTiles, MBTiles only allows tile coordinates from 0
+// to 2^z-1, so the pyramid is moved 6 zoom levels deeper and shifted by half
+// of that level to make room for the negative tiles around the origin.
+const MBTilesZoomOffset = 6
+
+// MBTilesStore is a Store backed by a single MBTiles (SQLite) file. Tiles are
+// moved as described by MBTilesZoomOffset, and rows are stored flipped as the
+// MBTiles spec requires.
+type MBTilesStore struct {
+	db *sql.DB
+}
+
+// OpenMBTiles opens the MBTiles file at path, creating it if it doesn't exist.
+func OpenMBTiles(path string) (*MBTilesStore, error) {
+	var db, err = sql.Open("sqlite3", path)
+	if err != nil {
+		return nil, err
+	}
+
+	// SQLite only allows a single writer, so funnel everything through one connection
+	// rather than fighting over the lock
+	db.SetMaxOpenConns(1)
+
+	var schema = []string{
+		`CREATE TABLE IF NOT EXISTS metadata (name TEXT, value TEXT)`,
+		`CREATE UNIQUE INDEX IF NOT EXISTS name ON metadata (name)`,
+		`CREATE TABLE IF NOT EXISTS tiles (zoom_level INTEGER, tile_column INTEGER, tile_row INTEGER, tile_data BLOB)`,
+		`CREATE UNIQUE INDEX IF NOT EXISTS tile_index ON tiles (zoom_level, tile_column, tile_row)`,
+	}
+
+	for _, stmt := range schema {
+		if _, err = db.Exec(stmt); err != nil {
+			db.Close()
+			return nil, fmt.Errorf("error creating mbtiles %s: %s", path, err)
+		}
+	}
+
+	return &MBTilesStore{db: db}, nil
+}
+
+// mbtilesCoord converts tile x, y at zoom z to the zoom level, column and row
+// used for it in an MBTiles archive.
+func mbtilesCoord(z, x, y int) (int, int, int) {
+	var mz = z + MBTilesZoomOffset
+	var shift = scale(mz - 1)
+	return mz, x + shift, scale(mz) - 1 - (y + shift)
+}
+
+// mbtilesTile is the inverse of mbtilesCoord for a tile at zoom z.
+func mbtilesTile(z, column, row int) image.Point {
+	var mz = z + MBTilesZoomOffset
+	var shift = scale(mz - 1)
+	return image.Point{X: column - shift, Y: scale(mz) - 1 - row - shift}
+}
+
+// tileLonLat returns the longitude and latitude of the top left corner of
+// tile x, y at zoom z, as a spherical mercator tile server would place it once
+// it's been moved by mbtilesCoord.
+func tileLonLat(z, x, y int) (float64, float64) {
+	var mz = z + MBTilesZoomOffset
+	var n = float64(scale(mz))
+	var shift = float64(scale(mz - 1))
+
+	var lon = (float64(x)+shift)/n*360 - 180
+	var lat = math.Atan(math.Sinh(math.Pi*(1-2*(float64(y)+shift)/n))) * 180 / math.Pi
+	return lon, lat
+}
+
+// lonLatTile is the inverse of tileLonLat, rounded to the nearest tile corner.
+func lonLatTile(z int, lon, lat float64) (int, int) {
+	var mz = z + MBTilesZoomOffset
+	var n = float64(scale(mz))
+	var shift = float64(scale(mz - 1))
+
+	var rad = lat * math.Pi / 180
+	var x = (lon+180)/360*n - shift
+	var y = (1-math.Log(math.Tan(rad)+1/math.Cos(rad))/math.Pi)/2*n - shift
+	return int(math.Round(x)), int(math.Round(y))
+}
+
+func formatFloat(f float64) string {
+	return strconv.FormatFloat(f, 'f', -1, 64)
+}
+
+func (s *MBTilesStore) ReadTile(z, x, y int) ([]byte, error) {
+	var data []byte
+	var mz, column, row = mbtilesCoord(z, x, y)
+	var err = s.db.QueryRow(
+		`SELECT tile_data FROM tiles WHERE zoom_level = ? AND tile_column = ? AND tile_row = ?`,
+		mz, column, row,
+	).Scan(&data)
+	if err == sql.ErrNoRows {
+		return nil, ErrNoTile
+	}
+
+	return data, err
+}
+
+func (s *MBTilesStore) WriteTile(z, x, y int, data []byte) error {
+	var mz, column, row = mbtilesCoord(z, x, y)
+	if column < 0 || row < 0 || column >= scale(mz) || row >= scale(mz) {
+		return &TileError{Zoom: z, X: x, Y: y, Err: fmt.Errorf("outside of the area an mbtiles archive can hold")}
+	}
+
+	var _, err = s.db.Exec(
+		`INSERT OR REPLACE INTO tiles (zoom_level, tile_column, tile_row, tile_data) VALUES (?, ?, ?, ?)`,
+		mz, column, row, data,
+	)
+
+	return err
+}
+
+func (s *MBTilesStore) DeleteTile(z, x, y int) error {
+	var mz, column, row = mbtilesCoord(z, x, y)
+	var _, err = s.db.Exec(
+		`DELETE FROM tiles WHERE zoom_level = ? AND tile_column = ? AND tile_row = ?`,
+		mz, column, row,
+	)
+
+	return err
+}
+
+func (s *MBTilesStore) Tiles(z int) ([]image.Point, error) {
+	var rows, err = s.db.Query(`SELECT tile_column, tile_row FROM tiles WHERE zoom_level = ?`, z+MBTilesZoomOffset)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var tiles []image.Point
+	for rows.Next() {
+		var column, row int
+		if err = rows.Scan(&column, &row); err != nil {
+			return nil, err
+		}
+
+		tiles = append(tiles, mbtilesTile(z, column, row))
+	}
+
+	return tiles, rows.Err()
+}
+
+// WriteMetadata replaces the metadata table with m. The zoom levels are
+// written as they're stored, moved by MBTilesZoomOffset, and the bounds and
+// center as the longitude and latitude of where the tiles are.
+func (s *MBTilesStore) WriteMetadata(m Metadata) error {
+	var left, top = tileLonLat(m.MaxZoom, m.Bounds.Min.X, m.Bounds.Min.Y)
+	var right, bottom = tileLonLat(m.MaxZoom, m.Bounds.Max.X, m.Bounds.Max.Y)
+
+	var values = map[string]string{
+		"name":        m.Name,
+		"type":        "baselayer",
+		"version":     "1",
+		"description": "Factorio map generated by maptorio",
+		"format":      m.Format.Ext(),
+		"tilesize":    strconv.Itoa(m.TileSize),
+		"minzoom":     strconv.Itoa(m.MinZoom + MBTilesZoomOffset),
+		"maxzoom":     strconv.Itoa(m.MaxZoom + MBTilesZoomOffset),
+		"bounds": fmt.Sprintf("%s,%s,%s,%s",
+			formatFloat(left), formatFloat(bottom), formatFloat(right), formatFloat(top)),
+		"center": fmt.Sprintf("%s,%s,%d",
+			formatFloat((left+right)/2), formatFloat((top+bottom)/2), m.MinZoom+MBTilesZoomOffset),
+	}
+
+	var tx, err = s.db.Begin()
+	if err != nil {
+		return err
+	}
+
+	if _, err = tx.Exec(`DELETE FROM metadata`); err != nil {
+		tx.Rollback()
+		return err
+	}
+
+	for name, value := range values {
+		if _, err = tx.Exec(`INSERT INTO metadata (name, value) VALUES (?, ?)`, name, value); err != nil {
+			tx.Rollback()
+			return err
+		}
+	}
+
+	return tx.Commit()
+}
+
+// ReadMetadata returns the metadata written by WriteMetadata, in the map's own
+// zoom levels and tile coordinates.
+func (s *MBTilesStore) ReadMetadata() (Metadata, error) {
+	var m Metadata
+	var rows, err = s.db.Query(`SELECT name, value FROM metadata`)
+	if err != nil {
+		return m, err
+	}
+	defer rows.Close()
+
+	var values = map[string]string{}
+	for rows.Next() {
+		var name, value string
+		if err = rows.Scan(&name, &value); err != nil {
+			return m, err
+		}
+
+		values[name] = value
+	}
+
+	if err = rows.Err(); err != nil {
+		return m, err
+	}
+
+	if m.Format, err = ParseFormat(values["format"], 0); err != nil {
+		return m, err
+	}
+
+	m.Name = values["name"]
+	m.TileSize, _ = strconv.Atoi(values["tilesize"])
+	m.MinZoom, _ = strconv.Atoi(values["minzoom"])
+	m.MaxZoom, _ = strconv.Atoi(values["maxzoom"])
+	m.MinZoom -= MBTilesZoomOffset
+	m.MaxZoom -= MBTilesZoomOffset
+
+	var left, bottom, right, top float64
+	if _, err = fmt.Sscanf(values["bounds"], "%g,%g,%g,%g", &left, &bottom, &right, &top); err == nil {
+		m.Bounds.Min.X, m.Bounds.Min.Y = lonLatTile(m.MaxZoom, left, top)
+		m.Bounds.Max.X, m.Bounds.Max.Y = lonLatTile(m.MaxZoom, right, bottom)
+	}
+
+	return m, nil
+}
+
+// Close closes the underlying database.
+func (s *MBTilesStore) Close() error {
+	return s.db.Close()
+}
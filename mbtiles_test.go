@@ -0,0 +1,120 @@
+package maptorio
+
+import (
+	"fmt"
+	"image"
+	"path/filepath"
+	"testing"
+)
+
+func TestMBTilesNegativeTiles(t *testing.T) {
+	var s, err = OpenMBTiles(filepath.Join(t.TempDir(), "map.mbtiles"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+
+	var tiles = []image.Point{{-1, -1}, {0, -1}, {-1, 0}, {0, 0}}
+	for z := 0; z <= 2; z++ {
+		for _, p := range tiles {
+			if err = s.WriteTile(z, p.X, p.Y, []byte{byte(z)}); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+
+	// Every tile has to be inside the spec's 0 to 2^z-1
+	var rows, _ = s.db.Query(`SELECT zoom_level, tile_column, tile_row FROM tiles`)
+	for rows.Next() {
+		var z, column, row int
+		rows.Scan(&z, &column, &row)
+		if column < 0 || row < 0 || column >= scale(z) || row >= scale(z) {
+			t.Errorf("tile %d, %d at zoom %d is out of range", column, row, z)
+		}
+	}
+	rows.Close()
+
+	var got []image.Point
+	if got, err = s.Tiles(2); err != nil {
+		t.Fatal(err)
+	}
+
+	if len(got) != len(tiles) {
+		t.Fatalf("got tiles %v, want %v", got, tiles)
+	}
+
+	for _, p := range tiles {
+		var data []byte
+		if data, err = s.ReadTile(2, p.X, p.Y); err != nil || len(data) != 1 || data[0] != 2 {
+			t.Errorf("tile %v at zoom 2 read back as %v, %v", p, data, err)
+		}
+	}
+}
+
+func TestMBTilesMetadata(t *testing.T) {
+	var s, err = OpenMBTiles(filepath.Join(t.TempDir(), "map.mbtiles"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+
+	var want = Metadata{
+		Name:     "railworld nauvis",
+		Format:   JPEG(0),
+		TileSize: 1024,
+		MinZoom:  2,
+		MaxZoom:  10,
+		Bounds:   image.Rect(-7, -32, 6, 31),
+	}
+
+	if err = s.WriteMetadata(want); err != nil {
+		t.Fatal(err)
+	}
+
+	var bounds, center string
+	s.db.QueryRow(`SELECT value FROM metadata WHERE name = 'bounds'`).Scan(&bounds)
+	s.db.QueryRow(`SELECT value FROM metadata WHERE name = 'center'`).Scan(&center)
+
+	var left, bottom, right, top float64
+	if n, _ := fmt.Sscanf(bounds, "%g,%g,%g,%g", &left, &bottom, &right, &top); n != 4 {
+		t.Fatalf("bounds %q aren't left,bottom,right,top", bounds)
+	}
+
+	if left < -180 || right > 180 || bottom < -85.06 || top > 85.06 || left >= right || bottom >= top {
+		t.Errorf("bounds %q aren't a valid longitude and latitude box", bounds)
+	}
+
+	if center == "" {
+		t.Error("no center")
+	}
+
+	var got Metadata
+	if got, err = s.ReadMetadata(); err != nil {
+		t.Fatal(err)
+	}
+
+	if got.MinZoom != want.MinZoom || got.MaxZoom != want.MaxZoom || got.Bounds != want.Bounds {
+		t.Errorf("read back %+v, want %+v", got, want)
+	}
+}
+
+func TestMBTilesOutOfRange(t *testing.T) {
+	var s, err = OpenMBTiles(filepath.Join(t.TempDir(), "map.mbtiles"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+
+	// Zoom 0 is moved to zoom 6, which has room for 32 tiles either side of the origin
+	for _, p := range []image.Point{{-33, 0}, {32, 0}, {0, -33}, {0, 32}} {
+		if err = s.WriteTile(0, p.X, p.Y, []byte{0}); err == nil {
+			t.Errorf("wrote tile %v at zoom 0", p)
+		}
+	}
+
+	for _, p := range []image.Point{{-32, -32}, {31, 31}} {
+		if err = s.WriteTile(0, p.X, p.Y, []byte{0}); err != nil {
+			t.Errorf("tile %v at zoom 0: %s", p, err)
+		}
+	}
+}
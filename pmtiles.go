@@ -0,0 +1,574 @@
+package maptorio
+
+import (
+	"bytes"
+	"compress/gzip"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"image"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+)
+
+// PMTilesZoomOffset is added to every zoom level when tiles are packed into a
+// PMTiles archive. PMTiles only allows tile coordinates from 0 to 2^z-1, but
+// the map is centered on the origin and so has negative tiles. Moving the
+// pyramid 6 zoom levels deeper and shifting it by half of that level leaves
+// room for every chunk the game can generate.
+const PMTilesZoomOffset = 6
+
+const (
+	pmtilesHeaderLength  = 127
+	pmtilesMaxRootLength = 16384 - pmtilesHeaderLength
+
+	pmtilesCompressionNone = 1
+	pmtilesCompressionGzip = 2
+)
+
+// pmtilesCoord converts tile x, y at zoom z to the zoom and coordinates used
+// for it in a PMTiles archive.
+func pmtilesCoord(z, x, y int) (int, int, int) {
+	var pz = z + PMTilesZoomOffset
+	var shift = scale(pz - 1)
+	return pz, x + shift, y + shift
+}
+
+// pmtilesID returns the PMTiles tile id for x, y at zoom z, which is the
+// position of the tile along a Hilbert curve over every zoom level up to z.
+func pmtilesID(z int, x, y uint64) uint64 {
+	// Every tile in the levels before this one comes first
+	var id = (uint64(1)<<uint(2*z) - 1) / 3
+
+	var n = uint64(1) << uint(z)
+	for s := n / 2; s > 0; s /= 2 {
+		var rx, ry uint64
+		if x&s > 0 {
+			rx = 1
+		}
+
+		if y&s > 0 {
+			ry = 1
+		}
+
+		id += s * s * ((3 * rx) ^ ry)
+
+		// Rotate the quadrant
+		if ry == 0 {
+			if rx == 1 {
+				x = n - 1 - x
+				y = n - 1 - y
+			}
+
+			x, y = y, x
+		}
+	}
+
+	return id
+}
+
+// pmtilesMetadata is the JSON metadata stored in the archive. The zoom levels
+// and bounds are the map's own, before PMTilesZoomOffset is applied.
+type pmtilesMetadata struct {
+	Name        string `json:"name"`
+	Description string `json:"description"`
+	Format      string `json:"format"`
+	TileSize    int    `json:"tilesize"`
+	MinZoom     int    `json:"minzoom"`
+	MaxZoom     int    `json:"maxzoom"`
+	ZoomOffset  int    `json:"zoom_offset"`
+	Bounds      []int  `json:"bounds"`
+}
+
+type pmtilesEntry struct {
+	id        uint64
+	offset    uint64
+	length    uint64
+	runLength uint64
+}
+
+// serializeDirectory encodes entries as a gzipped PMTiles directory.
+func serializeDirectory(entries []pmtilesEntry) ([]byte, error) {
+	var raw []byte
+	var buf = make([]byte, binary.MaxVarintLen64)
+	var put = func(v uint64) {
+		raw = append(raw, buf[:binary.PutUvarint(buf, v)]...)
+	}
+
+	put(uint64(len(entries)))
+
+	var last uint64
+	for _, e := range entries {
+		put(e.id - last)
+		last = e.id
+	}
+
+	for _, e := range entries {
+		put(e.runLength)
+	}
+
+	for _, e := range entries {
+		put(e.length)
+	}
+
+	for i, e := range entries {
+		// An offset that directly follows the previous entry is written as 0
+		if i > 0 && e.offset == entries[i-1].offset+entries[i-1].length {
+			put(0)
+		} else {
+			put(e.offset + 1)
+		}
+	}
+
+	return gzipBytes(raw)
+}
+
+func gzipBytes(data []byte) ([]byte, error) {
+	var buf bytes.Buffer
+	var zw = gzip.NewWriter(&buf)
+	if _, err := zw.Write(data); err != nil {
+		return nil, err
+	}
+
+	if err := zw.Close(); err != nil {
+		return nil, err
+	}
+
+	return buf.Bytes(), nil
+}
+
+// buildDirectories returns the root directory for entries and, if the
+// entries don't all fit in the root, the leaf directories it points to.
+func buildDirectories(entries []pmtilesEntry) ([]byte, []byte, error) {
+	var root, err = serializeDirectory(entries)
+	if err != nil || len(root) <= pmtilesMaxRootLength {
+		return root, nil, err
+	}
+
+	// Split the entries into leaves, growing the leaves until the root that
+	// points at them is small enough
+	for size := 4096; ; size *= 2 {
+		var leaves []byte
+		var rootEntries []pmtilesEntry
+
+		for i := 0; i < len(entries); i += size {
+			var end = min(i+size, len(entries))
+
+			var leaf []byte
+			if leaf, err = serializeDirectory(entries[i:end]); err != nil {
+				return nil, nil, err
+			}
+
+			rootEntries = append(rootEntries, pmtilesEntry{
+				id:     entries[i].id,
+				offset: uint64(len(leaves)),
+				length: uint64(len(leaf)),
+			})
+			leaves = append(leaves, leaf...)
+		}
+
+		if root, err = serializeDirectory(rootEntries); err != nil {
+			return nil, nil, err
+		}
+
+		if len(root) <= pmtilesMaxRootLength {
+			return root, leaves, nil
+		}
+	}
+}
+
+func pmtilesTileType(f Format) byte {
+	switch f.Ext() {
+	case "png":
+		return 2
+	case "jpg":
+		return 3
+	case "webp":
+		return 4
+	}
+
+	return 0
+}
+
+// WritePMTiles packs every tile in src from m.MinZoom to m.MaxZoom into a
+// PMTiles v3 archive at path, replacing any existing file. Tiles are shifted
+// as described by PMTilesZoomOffset, and identical tiles are only stored once.
+func WritePMTiles(path string, src Store, m Metadata) error {
+	type tileRef struct {
+		id      uint64
+		z, x, y int
+	}
+
+	var refs []tileRef
+	for z := m.MinZoom; z <= m.MaxZoom; z++ {
+		var tiles, err = src.Tiles(z)
+		if err != nil {
+			return err
+		}
+
+		for _, t := range tiles {
+			var pz, px, py = pmtilesCoord(z, t.X, t.Y)
+			if px < 0 || py < 0 || px >= scale(pz) || py >= scale(pz) {
+				return &TileError{Zoom: z, X: t.X, Y: t.Y, Err: fmt.Errorf("outside of the area a pmtiles archive can hold")}
+			}
+
+			refs = append(refs, tileRef{pmtilesID(pz, uint64(px), uint64(py)), z, t.X, t.Y})
+		}
+	}
+
+	sort.Slice(refs, func(i, j int) bool { return refs[i].id < refs[j].id })
+
+	// Tile data is collected in a temporary file first, since the directories
+	// that come before it can't be written until every tile has been seen
+	var data, err = ioutil.TempFile(filepath.Dir(path), ".pmtiles-")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(data.Name())
+	defer data.Close()
+
+	var entries []pmtilesEntry
+	var seen = map[[sha256.Size]byte]pmtilesEntry{}
+	var dataLength uint64
+	for _, ref := range refs {
+		var tile []byte
+		if tile, err = src.ReadTile(ref.z, ref.x, ref.y); err != nil {
+			return err
+		}
+
+		var sum = sha256.Sum256(tile)
+		var e, ok = seen[sum]
+		if !ok {
+			if _, err = data.Write(tile); err != nil {
+				return err
+			}
+
+			e = pmtilesEntry{offset: dataLength, length: uint64(len(tile))}
+			dataLength += e.length
+			seen[sum] = e
+		}
+
+		// Runs of the same tile share an entry
+		if n := len(entries); n > 0 && entries[n-1].offset == e.offset &&
+			entries[n-1].id+entries[n-1].runLength == ref.id {
+			entries[n-1].runLength++
+			continue
+		}
+
+		entries = append(entries, pmtilesEntry{id: ref.id, offset: e.offset, length: e.length, runLength: 1})
+	}
+
+	var root, leaves []byte
+	if root, leaves, err = buildDirectories(entries); err != nil {
+		return err
+	}
+
+	var meta []byte
+	if meta, err = json.Marshal(pmtilesMetadata{
+		Name:        m.Name,
+		Description: "Factorio map generated by maptorio",
+		Format:      m.Format.Ext(),
+		TileSize:    m.TileSize,
+		MinZoom:     m.MinZoom,
+		MaxZoom:     m.MaxZoom,
+		ZoomOffset:  PMTilesZoomOffset,
+		Bounds:      []int{m.Bounds.Min.X, m.Bounds.Min.Y, m.Bounds.Max.X, m.Bounds.Max.Y},
+	}); err != nil {
+		return err
+	}
+
+	if meta, err = gzipBytes(meta); err != nil {
+		return err
+	}
+
+	// Layout is header, root directory, metadata, leaf directories then the tile data
+	var rootOffset = uint64(pmtilesHeaderLength)
+	var metaOffset = rootOffset + uint64(len(root))
+	var leavesOffset = metaOffset + uint64(len(meta))
+	var dataOffset = leavesOffset + uint64(len(leaves))
+
+	var header = make([]byte, pmtilesHeaderLength)
+	copy(header, "PMTiles")
+	header[7] = 3
+	for i, v := range []uint64{
+		rootOffset, uint64(len(root)),
+		metaOffset, uint64(len(meta)),
+		leavesOffset, uint64(len(leaves)),
+		dataOffset, dataLength,
+		uint64(len(refs)), uint64(len(entries)), uint64(len(seen)),
+	} {
+		binary.LittleEndian.PutUint64(header[8+i*8:], v)
+	}
+
+	header[96] = 1 // clustered
+	header[97] = pmtilesCompressionGzip
+	header[98] = pmtilesCompressionNone
+	header[99] = pmtilesTileType(m.Format)
+	header[100] = byte(m.MinZoom + PMTilesZoomOffset)
+	header[101] = byte(m.MaxZoom + PMTilesZoomOffset)
+
+	// The map isn't geographic, so claim the whole world and center on the origin
+	var e7 = func(deg float64) uint32 { return uint32(int32(deg * 10000000)) }
+	binary.LittleEndian.PutUint32(header[102:], e7(-180))
+	binary.LittleEndian.PutUint32(header[106:], e7(-85))
+	binary.LittleEndian.PutUint32(header[110:], e7(180))
+	binary.LittleEndian.PutUint32(header[114:], e7(85))
+	header[118] = byte(m.MinZoom + PMTilesZoomOffset)
+
+	if _, err = data.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+
+	var out *os.File
+	if out, err = ioutil.TempFile(filepath.Dir(path), ".pmtiles-"); err != nil {
+		return err
+	}
+	defer os.Remove(out.Name())
+
+	for _, section := range [][]byte{header, root, meta, leaves} {
+		if _, err = out.Write(section); err != nil {
+			out.Close()
+			return err
+		}
+	}
+
+	if _, err = io.Copy(out, data); err != nil {
+		out.Close()
+		return err
+	}
+
+	if err = out.Chmod(0644); err != nil {
+		out.Close()
+		return err
+	}
+
+	if err = out.Close(); err != nil {
+		return err
+	}
+
+	return os.Rename(out.Name(), path)
+}
+
+// PMTilesReader reads tiles back out of a PMTiles archive written by
+// WritePMTiles.
+type PMTilesReader struct {
+	f *os.File
+
+	root         []pmtilesEntry
+	metaOffset   uint64
+	metaLength   uint64
+	leavesOffset uint64
+	dataOffset   uint64
+
+	mu     sync.Mutex
+	leaves map[uint64][]pmtilesEntry
+}
+
+// OpenPMTiles opens the PMTiles archive at path.
+func OpenPMTiles(path string) (*PMTilesReader, error) {
+	var f, err = os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+
+	var header = make([]byte, pmtilesHeaderLength)
+	if _, err = io.ReadFull(f, header); err != nil || string(header[:7]) != "PMTiles" || header[7] != 3 {
+		f.Close()
+		return nil, fmt.Errorf("%s is not a pmtiles v3 archive", path)
+	}
+
+	if header[97] != pmtilesCompressionGzip {
+		f.Close()
+		return nil, fmt.Errorf("unsupported directory compression in %s", path)
+	}
+
+	var r = &PMTilesReader{
+		f:            f,
+		metaOffset:   binary.LittleEndian.Uint64(header[24:]),
+		metaLength:   binary.LittleEndian.Uint64(header[32:]),
+		leavesOffset: binary.LittleEndian.Uint64(header[40:]),
+		dataOffset:   binary.LittleEndian.Uint64(header[56:]),
+		leaves:       map[uint64][]pmtilesEntry{},
+	}
+
+	var rootOffset = binary.LittleEndian.Uint64(header[8:])
+	var rootLength = binary.LittleEndian.Uint64(header[16:])
+	if r.root, err = r.readDirectory(rootOffset, rootLength); err != nil {
+		f.Close()
+		return nil, fmt.Errorf("error reading pmtiles %s: %s", path, err)
+	}
+
+	return r, nil
+}
+
+func (r *PMTilesReader) readDirectory(offset, length uint64) ([]pmtilesEntry, error) {
+	var compressed = make([]byte, length)
+	if _, err := r.f.ReadAt(compressed, int64(offset)); err != nil {
+		return nil, err
+	}
+
+	var zr, err = gzip.NewReader(bytes.NewReader(compressed))
+	if err != nil {
+		return nil, err
+	}
+
+	var raw []byte
+	if raw, err = ioutil.ReadAll(zr); err != nil {
+		return nil, err
+	}
+
+	var br = bytes.NewReader(raw)
+	var get = func() uint64 {
+		var v, verr = binary.ReadUvarint(br)
+		if verr != nil && err == nil {
+			err = verr
+		}
+		return v
+	}
+
+	// Every entry takes at least a byte, which catches a corrupt count before allocating for it
+	var count = get()
+	if count > uint64(len(raw)) {
+		return nil, fmt.Errorf("invalid directory with %d entries", count)
+	}
+
+	var entries = make([]pmtilesEntry, count)
+	var last uint64
+	for i := range entries {
+		last += get()
+		entries[i].id = last
+	}
+
+	for i := range entries {
+		entries[i].runLength = get()
+	}
+
+	for i := range entries {
+		entries[i].length = get()
+	}
+
+	for i := range entries {
+		var v = get()
+		if v == 0 && i > 0 {
+			entries[i].offset = entries[i-1].offset + entries[i-1].length
+		} else {
+			entries[i].offset = v - 1
+		}
+	}
+
+	return entries, err
+}
+
+// findEntry returns the entry covering id, if there is one.
+func findEntry(entries []pmtilesEntry, id uint64) (pmtilesEntry, bool) {
+	var i = sort.Search(len(entries), func(i int) bool { return entries[i].id > id }) - 1
+	if i < 0 {
+		return pmtilesEntry{}, false
+	}
+
+	var e = entries[i]
+
+	// Leaf directories have a run length of 0 and cover everything up to the next entry
+	if e.runLength == 0 || id < e.id+e.runLength {
+		return e, true
+	}
+
+	return pmtilesEntry{}, false
+}
+
+// ReadTile returns the tile at x, y for zoom level z, or ErrNoTile if the
+// archive doesn't have it.
+func (r *PMTilesReader) ReadTile(z, x, y int) ([]byte, error) {
+	var pz, px, py = pmtilesCoord(z, x, y)
+	if pz < 0 || px < 0 || py < 0 || px >= scale(pz) || py >= scale(pz) {
+		return nil, ErrNoTile
+	}
+
+	var id = pmtilesID(pz, uint64(px), uint64(py))
+	var entries = r.root
+	for {
+		var e, ok = findEntry(entries, id)
+		if !ok {
+			return nil, ErrNoTile
+		}
+
+		if e.runLength > 0 {
+			var data = make([]byte, e.length)
+			if _, err := r.f.ReadAt(data, int64(r.dataOffset+e.offset)); err != nil {
+				return nil, err
+			}
+
+			return data, nil
+		}
+
+		var err error
+		if entries, err = r.leaf(e); err != nil {
+			return nil, err
+		}
+	}
+}
+
+func (r *PMTilesReader) leaf(e pmtilesEntry) ([]pmtilesEntry, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if entries, ok := r.leaves[e.offset]; ok {
+		return entries, nil
+	}
+
+	var entries, err = r.readDirectory(r.leavesOffset+e.offset, e.length)
+	if err != nil {
+		return nil, err
+	}
+
+	r.leaves[e.offset] = entries
+	return entries, nil
+}
+
+// ReadMetadata returns the metadata the archive was written with.
+func (r *PMTilesReader) ReadMetadata() (Metadata, error) {
+	var m Metadata
+
+	var compressed = make([]byte, r.metaLength)
+	if _, err := r.f.ReadAt(compressed, int64(r.metaOffset)); err != nil {
+		return m, err
+	}
+
+	var zr, err = gzip.NewReader(bytes.NewReader(compressed))
+	if err != nil {
+		return m, err
+	}
+
+	var pm pmtilesMetadata
+	if err = json.NewDecoder(zr).Decode(&pm); err != nil {
+		return m, err
+	}
+
+	if pm.ZoomOffset != PMTilesZoomOffset {
+		return m, fmt.Errorf("unsupported pmtiles zoom offset %d", pm.ZoomOffset)
+	}
+
+	if m.Format, err = ParseFormat(pm.Format, 0); err != nil {
+		return m, err
+	}
+
+	m.Name = pm.Name
+	m.TileSize = pm.TileSize
+	m.MinZoom = pm.MinZoom
+	m.MaxZoom = pm.MaxZoom
+	if len(pm.Bounds) == 4 {
+		m.Bounds = image.Rect(pm.Bounds[0], pm.Bounds[1], pm.Bounds[2], pm.Bounds[3])
+	}
+
+	return m, nil
+}
+
+// Close closes the archive.
+func (r *PMTilesReader) Close() error {
+	return r.f.Close()
+}
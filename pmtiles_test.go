@@ -0,0 +1,178 @@
+package maptorio
+
+import (
+	"encoding/binary"
+	"fmt"
+	"image"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestPMTilesID(t *testing.T) {
+	// The ids from the PMTiles spec and its reference implementation
+	var tests = []struct {
+		z, x, y int
+		want    uint64
+	}{
+		{0, 0, 0, 0},
+		{1, 0, 0, 1},
+		{1, 0, 1, 2},
+		{1, 1, 1, 3},
+		{1, 1, 0, 4},
+		{2, 0, 0, 5},
+		{3, 0, 0, 21},
+		{12, 3423, 1763, 19078479},
+	}
+
+	for _, tt := range tests {
+		if got := pmtilesID(tt.z, uint64(tt.x), uint64(tt.y)); got != tt.want {
+			t.Errorf("pmtilesID(%d, %d, %d) = %d, want %d", tt.z, tt.x, tt.y, got, tt.want)
+		}
+	}
+}
+
+// readPMTilesHeader returns the 64 bit fields at the start of the header of
+// the archive at path.
+func readPMTilesHeader(t *testing.T, path string) []uint64 {
+	var f, err = os.Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+
+	var header = make([]byte, pmtilesHeaderLength)
+	if _, err = f.Read(header); err != nil {
+		t.Fatal(err)
+	}
+
+	var fields []uint64
+	for i := 8; i+8 <= 96; i += 8 {
+		fields = append(fields, binary.LittleEndian.Uint64(header[i:]))
+	}
+
+	return fields
+}
+
+// assertPMTiles opens the archive at path and checks every tile in src reads
+// back the same from it.
+func assertPMTiles(t *testing.T, path string, src *memStore) {
+	var r, err = OpenPMTiles(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Close()
+
+	for key, want := range src.tiles {
+		var z, x, y int
+		fmt.Sscanf(key, "%d/%dx%d", &z, &x, &y)
+
+		var got []byte
+		if got, err = r.ReadTile(z, x, y); err != nil || string(got) != string(want) {
+			t.Fatalf("tile %s read back as %q, %v, want %q", key, got, err, want)
+		}
+	}
+
+	if _, err = r.ReadTile(0, 5, 5); err != ErrNoTile {
+		t.Errorf("got %v for a tile that isn't in the archive, want %v", err, ErrNoTile)
+	}
+}
+
+func TestPMTilesRoundTrip(t *testing.T) {
+	var s = newMemStore()
+
+	// Every tile at zoom 2 is the same, so runs of them share an entry
+	s.tiles[tileKey(0, -1, -1)] = []byte("zoom 0")
+	for x := -1; x <= 0; x++ {
+		for y := -1; y <= 0; y++ {
+			s.tiles[tileKey(1, x, y)] = []byte(fmt.Sprintf("zoom 1 %dx%d", x, y))
+		}
+	}
+
+	for x := -2; x <= 1; x++ {
+		for y := -2; y <= 1; y++ {
+			s.tiles[tileKey(2, x, y)] = []byte("zoom 2")
+		}
+	}
+
+	var path = filepath.Join(t.TempDir(), "map.pmtiles")
+	var want = Metadata{
+		Name:     "railworld nauvis",
+		Format:   JPEG(0),
+		TileSize: 1024,
+		MinZoom:  0,
+		MaxZoom:  2,
+		Bounds:   image.Rect(-2, -2, 2, 2),
+	}
+
+	if err := WritePMTiles(path, s, want); err != nil {
+		t.Fatal(err)
+	}
+
+	var header = readPMTilesHeader(t, path)
+	if header[5] != 0 {
+		t.Errorf("%d bytes of leaf directories for %d tiles", header[5], len(s.tiles))
+	}
+
+	var addressed, entries, contents = header[8], header[9], header[10]
+	if addressed != 21 || contents != 6 || entries >= addressed {
+		t.Errorf("%d tiles stored as %d entries and %d contents, want 21 tiles, 6 contents and fewer entries", addressed, entries, contents)
+	}
+
+	assertPMTiles(t, path, s)
+
+	var r, err = OpenPMTiles(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Close()
+
+	var got Metadata
+	if got, err = r.ReadMetadata(); err != nil {
+		t.Fatal(err)
+	}
+
+	if got.Name != want.Name || got.Format.Ext() != "jpg" || got.TileSize != want.TileSize ||
+		got.MinZoom != want.MinZoom || got.MaxZoom != want.MaxZoom || got.Bounds != want.Bounds {
+		t.Errorf("read back %+v, want %+v", got, want)
+	}
+}
+
+func TestPMTilesLeafDirectories(t *testing.T) {
+	var s = newMemStore()
+
+	// Enough scattered tiles of different sizes that the directory doesn't fit
+	// in the root
+	var rnd = rand.New(rand.NewSource(1))
+	for x := -128; x < 128; x++ {
+		for y := -128; y < 128; y++ {
+			if rnd.Intn(3) == 0 {
+				s.tiles[tileKey(8, x, y)] = make([]byte, 1+rnd.Intn(1000))
+				rnd.Read(s.tiles[tileKey(8, x, y)])
+			}
+		}
+	}
+
+	var path = filepath.Join(t.TempDir(), "map.pmtiles")
+	if err := WritePMTiles(path, s, Metadata{Format: JPEG(0), MinZoom: 8, MaxZoom: 8}); err != nil {
+		t.Fatal(err)
+	}
+
+	var header = readPMTilesHeader(t, path)
+	if header[1] > pmtilesMaxRootLength || header[5] == 0 {
+		t.Fatalf("%d byte root and %d bytes of leaves for %d tiles, want leaves", header[1], header[5], len(s.tiles))
+	}
+
+	assertPMTiles(t, path, s)
+}
+
+func TestPMTilesOutOfRange(t *testing.T) {
+	var s = newMemStore()
+	s.tiles[tileKey(0, 32, 0)] = []byte("too far")
+
+	var err = WritePMTiles(filepath.Join(t.TempDir(), "map.pmtiles"), s, Metadata{Format: JPEG(0)})
+	if _, ok := err.(*TileError); !ok {
+		t.Errorf("got %v, want a *TileError", err)
+	}
+}
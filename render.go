@@ -2,14 +2,17 @@ package maptorio // import "code.heyviddy.com/maptorio"
 
 import (
 	"bytes"
+	"context"
+	"errors"
 	"fmt"
 	"image"
+	"image/draw"
 	"image/jpeg"
 	"io"
 	"math"
 	"os"
 	"path/filepath"
-	"strconv"
+	"sort"
 	"strings"
 	"sync"
 
@@ -18,10 +21,6 @@ import (
 	"github.com/nfnt/resize"
 )
 
-var empty image.Image
-
-const maxZoom = 10
-
 type point struct {
 	x, y int
 }
@@ -30,51 +29,366 @@ func (p *point) String() string {
 	return fmt.Sprintf("(%d, %d)", p.x, p.y)
 }
 
-// Max of 48 operations running at a time
-var limiter = make(chan struct{}, 48)
+// ErrorPolicy determines how Render reacts to a tile that could not be built.
+type ErrorPolicy int
+
+const (
+	// AbortOnError stops rendering as soon as any tile fails.
+	AbortOnError ErrorPolicy = iota
+
+	// SkipOnError skips tiles that fail and reports all of them once every
+	// zoom level has been rendered.
+	SkipOnError
+)
+
+// TileError is the error for a single tile that could not be built.
+type TileError struct {
+	Zoom, X, Y int
+	Err        error
+}
+
+func (e *TileError) Error() string {
+	return fmt.Sprintf("tile %dx%d at zoom %d: %s", e.X, e.Y, e.Zoom, e.Err)
+}
+
+func (e *TileError) Unwrap() error {
+	return e.Err
+}
+
+// RenderError collects every tile that failed during a render.
+type RenderError struct {
+	Tiles []*TileError
+}
+
+func (e *RenderError) Error() string {
+	var lines = []string{fmt.Sprintf("%d tiles failed to render", len(e.Tiles))}
+	for _, t := range e.Tiles {
+		lines = append(lines, "  "+t.Error())
+	}
+
+	return strings.Join(lines, "\n")
+}
+
+// Renderer builds the lower zoom levels of a tile pyramid by folding each 2x2
+// square of tiles into a single tile of the next level down. A Renderer holds
+// no state between calls to Render, so any number of them can run side by side.
+type Renderer struct {
+	concurrency int
+	tileSize    int
+	minZoom     int
+	maxZoom     int
+	placeholder image.Image
+	store       Store
+	format      Format
+	policy      ErrorPolicy
+	manifest    string
+	resume      bool
+	output      io.Writer
+}
+
+// Option configures a Renderer.
+type Option func(*Renderer)
 
-func Render(wd string) {
+// WithConcurrency sets the number of tiles built at the same time, which must
+// be at least 1. The default is 48.
+func WithConcurrency(n int) Option {
+	return func(r *Renderer) {
+		r.concurrency = n
+	}
+}
+
+// WithTileSize sets the width and height in pixels of every tile, which must
+// be at least 1. The default is 1024.
+func WithTileSize(px int) Option {
+	return func(r *Renderer) {
+		r.tileSize = px
+	}
+}
+
+// WithZoomRange sets the zoom levels of the pyramid. The source tiles are read
+// from max and levels are built down to min, stopping early once a level
+// is a single tile. min can't be negative or above max. The default is 0 to 10.
+func WithZoomRange(min, max int) Option {
+	return func(r *Renderer) {
+		r.minZoom = min
+		r.maxZoom = max
+	}
+}
+
+// WithPlaceholder sets the image used in place of missing tiles. The default
+// is a solid black tile.
+func WithPlaceholder(im image.Image) Option {
+	return func(r *Renderer) {
+		r.placeholder = im
+	}
+}
+
+// WithFormat sets the encoding of both the source tiles and the tiles that are
+// built. The default is JPEG at the default quality.
+func WithFormat(f Format) Option {
+	return func(r *Renderer) {
+		r.format = f
+	}
+}
+
+// WithStore sets where tiles are read from and written to. It is required,
+// except when using the package level Render.
+func WithStore(s Store) Option {
+	return func(r *Renderer) {
+		r.store = s
+	}
+}
+
+// WithErrorPolicy sets how failing tiles are handled. The default is
+// AbortOnError.
+func WithErrorPolicy(p ErrorPolicy) Option {
+	return func(r *Renderer) {
+		r.policy = p
+	}
+}
+
+// WithManifest enables incremental rebuilds. The content of every source tile
+// is recorded in a manifest at path after each successful render, and the next
+// render only rebuilds the tiles whose source tiles were added, changed or
+// removed since then. Without an existing manifest everything is rebuilt.
+func WithManifest(path string) Option {
+	return func(r *Renderer) {
+		r.manifest = path
+	}
+}
+
+// WithResume lets a render that was interrupted pick up where it left off. The
+// tiles a render has built are recorded next to the manifest until it
+// finishes, and resuming skips those as long as the source tiles are the same
+// as they were then; every other tile that needs building is still built. It
+// requires WithManifest.
+func WithResume(resume bool) Option {
+	return func(r *Renderer) {
+		r.resume = resume
+	}
+}
+
+// WithOutput sets where the Renderer reports its progress: a few lines for
+// each zoom level and a progress bar of its tiles. The default is to report
+// nothing.
+func WithOutput(w io.Writer) Option {
+	return func(r *Renderer) {
+		r.output = w
+	}
+}
+
+// NewRenderer returns a Renderer configured with opts. Invalid options are
+// reported by Render.
+func NewRenderer(opts ...Option) *Renderer {
+	var r = &Renderer{
+		concurrency: 48,
+		tileSize:    1024,
+		minZoom:     0,
+		maxZoom:     10,
+		format:      JPEG(0),
+		policy:      AbortOnError,
+	}
+
+	for _, opt := range opts {
+		opt(r)
+	}
+
+	if r.tileSize < 1 {
+		// Render refuses to run, so there's nothing to size a placeholder for
+	} else if r.placeholder == nil {
+		var im = image.NewRGBA(image.Rect(0, 0, r.tileSize, r.tileSize))
+		draw.Draw(im, im.Bounds(), image.Black, image.Point{}, draw.Src)
+		r.placeholder = im
+	} else if b := r.placeholder.Bounds(); b.Dx() != r.tileSize || b.Dy() != r.tileSize {
+		// The placeholder sits in the grid next to real tiles, so it has to be the same size
+		r.placeholder = resize.Resize(uint(r.tileSize), uint(r.tileSize), r.placeholder, resize.Bilinear)
+	}
+
+	return r
+}
+
+// Render builds zoom levels 9 through 0 from the tiles at zoom 10 under the
+// working directory wd (or the zoom range set in opts), using wd/empty.jpg as
+// the placeholder for missing tiles. Any opts are applied on top of those,
+// and unless one of them sets a store the tiles are read from and written to
+// a DirStore in wd/tiles. See Renderer.Render for how errors and cancellation
+// are reported.
+func Render(ctx context.Context, wd string, opts ...Option) error {
 	// Read in the empty jpeg to use as filler
 	var path string
 	var emptyF *os.File
+	var empty image.Image
 	var err error
 
 	if path, err = filepath.Abs(filepath.Join(wd, "empty.jpg")); err != nil {
-		panic(err)
+		return err
 	}
 
-	fmt.Println("using empty asset path of", path)
 	if emptyF, err = os.Open(path); err != nil {
-		panic(err)
+		return err
 	}
 	defer emptyF.Close()
 
 	if empty, err = jpeg.Decode(emptyF); err != nil {
-		panic(err)
+		return fmt.Errorf("error decoding empty asset %s: %s", path, err)
 	}
 
-	for z := 9; z >= 0; z-- {
-		if hasmore := makeLevel(wd, z); !hasmore {
+	var r = NewRenderer(append([]Option{WithPlaceholder(empty)}, opts...)...)
+	r.logf("using empty asset path of %s\n", path)
+	if r.store == nil {
+		r.store = NewDirStore(filepath.Join(wd, "tiles"), r.format.Ext())
+	}
+
+	return r.Render(ctx)
+}
+
+// Render builds every zoom level below the maximum from the tiles in the
+// store. With AbortOnError the first failing tile is returned as a *TileError,
+// with SkipOnError any failures are returned together as a *RenderError after
+// all levels are built.
+//
+// Once ctx is done no new tiles are started, tiles already being built are
+// discarded rather than written and Render returns ctx.Err().
+func (r *Renderer) Render(ctx context.Context) error {
+	if err := r.validate(); err != nil {
+		return err
+	}
+
+	if r.store == nil {
+		return errors.New("renderer has no store")
+	}
+
+	// dirty holds the tiles that need to be rebuilt at the level we're on, nil
+	// meaning all of them
+	var dirty map[point]bool
+	var current manifest
+	var done *progress
+	if r.manifest != "" {
+		var err error
+		if dirty, current, err = r.changedTiles(); err != nil {
+			return err
+		}
+
+		if dirty == nil {
+			r.logf("No previous manifest, rebuilding every tile\n")
+		} else {
+			r.logf("Found %d changed source tiles\n", len(dirty))
+		}
+
+		// Anything an interrupted render left behind is only trusted when
+		// resuming it, and only if it was building from these same source tiles
+		if r.resume {
+			if done, err = loadProgress(r.progressPath(), current); err != nil {
+				return err
+			}
+
+			r.logf("Resuming with %d tiles already built\n", len(done.Tiles))
+		} else {
+			done = newProgress(current)
+		}
+	}
+
+	var failed []*TileError
+	for z := r.maxZoom - 1; z >= r.minZoom; z-- {
+		if dirty != nil {
+			dirty = parents(dirty)
+		}
+
+		var hasmore, errs, err = r.makeLevel(ctx, z, dirty, done)
+		if done != nil {
+			if perr := done.save(r.progressPath()); perr != nil && err == nil {
+				err = perr
+			}
+		}
+
+		if err != nil {
+			return err
+		}
+
+		failed = append(failed, errs...)
+		if r.policy == AbortOnError && len(failed) > 0 {
+			return failed[0]
+		}
+
+		if !hasmore {
 			break
 		}
 	}
+
+	if len(failed) > 0 {
+		return &RenderError{failed}
+	}
+
+	// Only record the manifest once everything built, so anything that failed is
+	// retried next time
+	if r.manifest != "" {
+		if err := current.save(r.manifest); err != nil {
+			return err
+		}
+
+		if err := os.Remove(r.progressPath()); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// progressPath is where the tiles built so far are recorded until the render
+// finishes.
+func (r *Renderer) progressPath() string {
+	return r.manifest + ".partial"
+}
+
+// validate reports any option that Render can't work with.
+func (r *Renderer) validate() error {
+	if r.concurrency < 1 {
+		return fmt.Errorf("invalid concurrency %d, must be at least 1", r.concurrency)
+	}
+
+	if r.tileSize < 1 {
+		return fmt.Errorf("invalid tile size %d, must be at least 1", r.tileSize)
+	}
+
+	if r.minZoom < 0 || r.minZoom > r.maxZoom {
+		return fmt.Errorf("invalid zoom range %d to %d", r.minZoom, r.maxZoom)
+	}
+
+	if r.resume && r.manifest == "" {
+		return errors.New("resuming a render needs a manifest")
+	}
+
+	return nil
 }
 
-func makeLevel(wd string, z int) bool {
-	fmt.Printf("Making zoom level %d.\n", z)
+// logf reports progress to the renderer's output, if it has one.
+func (r *Renderer) logf(format string, args ...interface{}) {
+	if r.output != nil {
+		fmt.Fprintf(r.output, format, args...)
+	}
+}
 
-	var topleft, bottomright = determineArea(wd, z+1)
+// makeLevel builds zoom level z from level z+1, limited to the tiles in dirty
+// unless it is nil. Tiles are recorded in done as they're built, and with
+// resume any it already has are skipped. It returns whether there are more
+// levels to build along with the tiles that failed. Once a tile fails under
+// AbortOnError no further tiles are started, and once ctx is done the level
+// is abandoned with ctx.Err().
+func (r *Renderer) makeLevel(ctx context.Context, z int, dirty map[point]bool, done *progress) (bool, []*TileError, error) {
+	r.logf("Making zoom level %d.\n", z)
 
-	// Determine the total number of tiles necessary for this layer so we can initialize the progress bar
+	var topleft, bottomright, err = r.determineArea(z + 1)
+	if err != nil {
+		return false, nil, err
+	}
+
+	// Determine the total number of tiles in this layer so we know once we've reached the last one
 	var width = bottomright.x - topleft.x
 	var height = bottomright.y - topleft.y
 
 	var total = int(math.Ceil(float64(width)/2) * math.Ceil(float64(height)/2))
 
-	fmt.Printf("  topleft: %+v; bottomright: %+v; total: %d\n", topleft, bottomright, total)
-	var bar = pb.StartNew(total)
-
-	var wg sync.WaitGroup
+	r.logf("  topleft: %+v; bottomright: %+v; total: %d\n", topleft, bottomright, total)
 
 	// Now that we know the topleft and bottomright, we can iterate over those and make a new layer
 	// If the bottom right is an even number we want to generate a tile
@@ -82,133 +396,208 @@ func makeLevel(wd string, z int) bool {
 	// once we go over
 	// The lowest zoom level should render as a single tile containing the entire map plus black
 	// borders to fill in any gaps
-	for x := topleft.x; x <= bottomright.x; x += 2 {
-		for y := topleft.y; y <= bottomright.y; y += 2 {
-			// We can jump by 2 for each iteration because we're going to fold 2x2 tiles in each subsequent image
-			fmt.Printf("Making tile for %d, %d to %d, %d\n", x, y, x+1, y+1)
-			wg.Add(1)
-			go func(z, x, y int) {
-				// Block until there's an available token
-				limiter <- struct{}{}
-
-				defer func() {
-					<-limiter
-					bar.Increment()
-					wg.Done()
-				}()
+	var sources []point
+	if dirty == nil {
+		for x := topleft.x; x <= bottomright.x; x += 2 {
+			for y := topleft.y; y <= bottomright.y; y += 2 {
+				sources = append(sources, point{x, y})
+			}
+		}
+	} else {
+		// Only the tiles that changed, each of which is built from the 2x2 square starting at double its position
+		for t := range dirty {
+			sources = append(sources, point{t.x * 2, t.y * 2})
+		}
+
+		sort.Slice(sources, func(i, j int) bool {
+			return sources[i].x < sources[j].x || (sources[i].x == sources[j].x && sources[i].y < sources[j].y)
+		})
+	}
+
+	if r.resume {
+		var remaining = sources[:0]
+		for _, p := range sources {
+			if !done.done(z, half(p.x), half(p.y)) {
+				remaining = append(remaining, p)
+			}
+		}
+
+		sources = remaining
+	}
 
-				makeTile(wd, z, x, y)
+	var bar *pb.ProgressBar
+	if r.output != nil {
+		bar = pb.New(len(sources))
+		bar.Output = r.output
+		bar.Start()
+	}
 
-			}(z, x, y)
+	var wg sync.WaitGroup
+	var mu sync.Mutex
+	var failed []*TileError
+
+	// Limit the number of tiles in flight at a time
+	var limiter = make(chan struct{}, r.concurrency)
+
+schedule:
+	for _, p := range sources {
+		// Block until there's an available token, or stop scheduling entirely if we've been cancelled
+		select {
+		case limiter <- struct{}{}:
+		case <-ctx.Done():
+			break schedule
 		}
+
+		// Under AbortOnError nothing new is started once a tile has failed, only the
+		// ones already being built are finished
+		mu.Lock()
+		var aborted = r.policy == AbortOnError && len(failed) > 0
+		mu.Unlock()
+		if aborted {
+			<-limiter
+			break schedule
+		}
+
+		// We jump by 2 for each tile because we're going to fold 2x2 tiles in each subsequent image
+		wg.Add(1)
+		go func(z, x, y int) {
+			defer func() {
+				<-limiter
+				if bar != nil {
+					bar.Increment()
+				}
+				wg.Done()
+			}()
+
+			if err := r.makeTile(ctx, z, x, y); err != nil {
+				mu.Lock()
+				failed = append(failed, &TileError{Zoom: z, X: half(x), Y: half(y), Err: err})
+				mu.Unlock()
+			} else if done != nil && ctx.Err() == nil {
+				// A tile dropped because we were cancelled isn't done
+				done.add(z, half(x), half(y))
+			}
+
+		}(z, p.x, p.y)
 	}
 
 	wg.Wait()
-	bar.FinishPrint(fmt.Sprintf("Completed zoom level %d\n", z))
+
+	if bar != nil {
+		bar.Finish()
+	}
+
+	if err := ctx.Err(); err != nil {
+		r.logf("Cancelled zoom level %d\n\n", z)
+		return false, failed, err
+	}
+
+	r.logf("Completed zoom level %d\n\n", z)
 
 	// As soon as we hit the point where we're only generating 1 tile, stop processing
 	if total <= 1 {
-		return false
+		return false, failed, nil
 	}
 
-	return true
+	return true, failed, nil
 }
 
-func makeTile(wd string, z, x, y int) {
+func (r *Renderer) makeTile(ctx context.Context, z, x, y int) error {
 	// makes a single tile
-	var tiles = readImages(wd, z+1, x, y)
+	var tiles, err = r.readImages(z+1, x, y)
+	if err != nil {
+		return err
+	}
+
 	if tiles == nil {
 		//fmt.Printf("Skipping tile (%d,%d)@%d because there are no source tiles\n", x, y, z)
-		return
+		// Any tile left over from an earlier render no longer has anything in it
+		return r.store.DeleteTile(z, half(x), half(y))
 	}
 
-	var tile, err = imagegrid.Draw(2, tiles)
-	if err != nil {
-		panic(err)
+	var tile image.Image
+	if tile, err = imagegrid.Draw(2, tiles); err != nil {
+		return err
 	}
 
 	// Resize to half and write it back out
-	var im = resize.Thumbnail(1024, 1024, tile, resize.Bicubic)
+	var im = resize.Thumbnail(uint(r.tileSize), uint(r.tileSize), tile, resize.Bicubic)
+
+	// Drop the tile instead of writing it if we were cancelled while building it
+	if ctx.Err() != nil {
+		return nil
+	}
 
 	// And write the resized image
-	//writeImage(z, x/pow(2, (maxZoom-z)), y/pow(2, (maxZoom-z)), im)
 	//fmt.Printf("Writing tile (%d,%d)@%d to tile %dx%d.jpg\n", x, y, z, half(x), half(y))
-	writeImage(wd, z, half(x), half(y), im)
+	return r.writeImage(z, half(x), half(y), im)
 }
 
-func readImages(wd string, z, x, y int) []image.Image {
+func (r *Renderer) readImages(z, x, y int) ([]image.Image, error) {
 	// this function takes in a source coordinate and returns the 2x2 square of source images
-	// but if all of the source images are empty we can skip it
-	var tl = readImage(wd, z, x, y)
-	var tr = readImage(wd, z, x+1, y)
-	var bl = readImage(wd, z, x, y+1)
-	var br = readImage(wd, z, x+1, y+1)
+	// but if all of the source images are missing we can skip it
+	var images = make([]image.Image, 4)
+	var found bool
+	for i, p := range []point{{x, y}, {x + 1, y}, {x, y + 1}, {x + 1, y + 1}} {
+		var err error
+		if images[i], err = r.readImage(z, p.x, p.y); err != nil {
+			return nil, err
+		}
 
-	if tl == empty && tr == empty && bl == empty && br == empty {
-		return nil
+		if images[i] == nil {
+			images[i] = r.placeholder
+		} else {
+			found = true
+		}
 	}
 
-	return []image.Image{tl, tr, bl, br}
+	if !found {
+		return nil, nil
+	}
+
+	return images, nil
 }
 
-func readImage(wd string, z, x, y int) image.Image {
-	var fd *os.File
-	var err error
-	var path = filepath.Join(wd, "tiles", strconv.Itoa(z), fmt.Sprintf("%dx%d.jpg", x, y))
-	if fd, err = os.Open(path); os.IsNotExist(err) {
-		return empty
+// readImage returns the decoded tile, or nil if it doesn't exist.
+func (r *Renderer) readImage(z, x, y int) (image.Image, error) {
+	var data, err = r.store.ReadTile(z, x, y)
+	if err == ErrNoTile {
+		return nil, nil
 	} else if err != nil {
-		panic(err)
+		return nil, err
 	}
-	defer fd.Close()
 
 	var im image.Image
-	if im, err = jpeg.Decode(fd); err != nil {
-		panic(fmt.Sprintf("got error decoding jpeg %s: %s", fd.Name(), err))
+	if im, err = r.format.Decode(bytes.NewReader(data)); err != nil {
+		return nil, fmt.Errorf("error decoding %s %dx%d at zoom %d: %s", r.format.Ext(), x, y, z, err)
 	}
 
-	return im
+	return im, nil
 }
 
-func writeImage(wd string, z, x, y int, im image.Image) error {
-	// Make sure the directory exists first
-	var d = filepath.Join(wd, "tiles", strconv.Itoa(z))
-	os.Mkdir(d, os.ModePerm)
-	var out, err = os.Create(filepath.Join(d, fmt.Sprintf("%dx%d.jpg", x, y)))
-	if err != nil {
-		panic(err)
-	}
-	defer out.Close()
-
+func (r *Renderer) writeImage(z, x, y int, im image.Image) error {
 	var buf = new(bytes.Buffer)
-
-	if err = jpeg.Encode(buf, im, nil); err != nil {
-		panic(fmt.Sprintf("error encoding file %s, got %s", out.Name(), err))
+	if err := r.format.Encode(buf, im); err != nil {
+		return fmt.Errorf("error encoding tile %dx%d at zoom %d: %s", x, y, z, err)
 	}
 
-	io.Copy(out, buf)
-
-	return nil
+	return r.store.WriteTile(z, x, y, buf.Bytes())
 }
 
-func determineArea(wd string, z int) (point, point) {
-	var d = filepath.Join(wd, "tiles", strconv.Itoa(z))
-	var files, _ = filepath.Glob(filepath.Join(d, "*.jpg"))
+func (r *Renderer) determineArea(z int) (point, point, error) {
+	var tiles, err = r.store.Tiles(z)
+	if err != nil {
+		return point{}, point{}, err
+	}
 
 	// First, we need to figure out the absolute topleft and bottomright of the source tiles
 	// this is used to iterate over and build subsequent layers
 	var topleft = point{0, 0}
 	var bottomright = point{0, 0}
-	fmt.Printf("Determining area for zoom level %d\n", z)
-
-	for _, fp := range files {
-		var f = filepath.Base(fp)
-		f = strings.TrimSuffix(f, ".jpg")
-		//fmt.Printf("\t%s : %s\n", fp, f)
+	r.logf("Determining area for zoom level %d\n", z)
 
-		var parts = strings.Split(f, "x")
-		var x, _ = strconv.Atoi(parts[0])
-		var y, _ = strconv.Atoi(parts[1])
+	for _, t := range tiles {
+		var x, y = t.X, t.Y
 
 		topleft.x = min(topleft.x, x-abs(x%2))
 		topleft.y = min(topleft.y, y-abs(y%2))
@@ -216,7 +605,7 @@ func determineArea(wd string, z int) (point, point) {
 		bottomright.y = max(bottomright.y, y)
 	}
 
-	return topleft, bottomright
+	return topleft, bottomright, nil
 }
 
 func abs(a int) int {
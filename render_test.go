@@ -0,0 +1,381 @@
+package maptorio
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"image"
+	"image/color"
+	"image/draw"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"testing"
+)
+
+// memStore is a Store in memory that records every tile written to it.
+type memStore struct {
+	mu      sync.Mutex
+	tiles   map[string][]byte
+	writes  []string
+	onWrite func()
+}
+
+func newMemStore() *memStore {
+	return &memStore{tiles: map[string][]byte{}}
+}
+
+func tileKey(z, x, y int) string {
+	return fmt.Sprintf("%d/%dx%d", z, x, y)
+}
+
+func (s *memStore) ReadTile(z, x, y int) ([]byte, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var data, ok = s.tiles[tileKey(z, x, y)]
+	if !ok {
+		return nil, ErrNoTile
+	}
+
+	return data, nil
+}
+
+func (s *memStore) WriteTile(z, x, y int, data []byte) error {
+	s.mu.Lock()
+	s.tiles[tileKey(z, x, y)] = data
+	s.writes = append(s.writes, tileKey(z, x, y))
+	var onWrite = s.onWrite
+	s.mu.Unlock()
+
+	if onWrite != nil {
+		onWrite()
+	}
+
+	return nil
+}
+
+func (s *memStore) DeleteTile(z, x, y int) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.tiles, tileKey(z, x, y))
+	return nil
+}
+
+func (s *memStore) Tiles(z int) ([]image.Point, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var points []image.Point
+	for key := range s.tiles {
+		var tz, x, y int
+		fmt.Sscanf(key, "%d/%dx%d", &tz, &x, &y)
+		if tz == z {
+			points = append(points, image.Point{x, y})
+		}
+	}
+
+	return points, nil
+}
+
+// written returns the tiles written since the last call, sorted.
+func (s *memStore) written() []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var out = s.writes
+	s.writes = nil
+	sort.Strings(out)
+	return out
+}
+
+func (s *memStore) has(z, x, y int) bool {
+	var _, err = s.ReadTile(z, x, y)
+	return err == nil
+}
+
+const testTileSize = 8
+
+var testFormat, _ = ParseFormat("png", 0)
+
+// putSource writes a solid source tile at zoom 2.
+func putSource(t *testing.T, s *memStore, x, y int, c color.Color) {
+	var im = image.NewRGBA(image.Rect(0, 0, testTileSize, testTileSize))
+	draw.Draw(im, im.Bounds(), image.NewUniform(c), image.Point{}, draw.Src)
+
+	var buf = new(bytes.Buffer)
+	if err := testFormat.Encode(buf, im); err != nil {
+		t.Fatal(err)
+	}
+
+	s.mu.Lock()
+	s.tiles[tileKey(2, x, y)] = buf.Bytes()
+	s.mu.Unlock()
+}
+
+// newTestStore returns a store with a 4x4 square of source tiles at zoom 2.
+func newTestStore(t *testing.T) *memStore {
+	var s = newMemStore()
+	for x := 0; x < 4; x++ {
+		for y := 0; y < 4; y++ {
+			putSource(t, s, x, y, color.RGBA{0, 0, 255, 255})
+		}
+	}
+
+	return s
+}
+
+func newTestRenderer(s Store, dir string, opts ...Option) *Renderer {
+	return NewRenderer(append([]Option{
+		WithStore(s),
+		WithTileSize(testTileSize),
+		WithZoomRange(0, 2),
+		WithFormat(testFormat),
+		WithConcurrency(1),
+		WithManifest(filepath.Join(dir, "manifest.json")),
+	}, opts...)...)
+}
+
+func render(t *testing.T, s Store, dir string, opts ...Option) {
+	if err := newTestRenderer(s, dir, opts...).Render(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func assertWritten(t *testing.T, s *memStore, want ...string) {
+	var got = s.written()
+	sort.Strings(want)
+	if fmt.Sprint(got) != fmt.Sprint(want) {
+		t.Errorf("wrote %v, want %v", got, want)
+	}
+}
+
+// assertPixel checks the colour of pixel px, py in a tile.
+func assertPixel(t *testing.T, s *memStore, z, x, y, px, py int, want color.RGBA) {
+	var data, err = s.ReadTile(z, x, y)
+	if err != nil {
+		t.Fatalf("tile %s: %s", tileKey(z, x, y), err)
+	}
+
+	var im image.Image
+	if im, err = testFormat.Decode(bytes.NewReader(data)); err != nil {
+		t.Fatal(err)
+	}
+
+	var r, g, b, _ = im.At(px, py).RGBA()
+	var got = color.RGBA{uint8(r >> 8), uint8(g >> 8), uint8(b >> 8), 255}
+	if got != want {
+		t.Errorf("tile %s pixel %d, %d is %v, want %v", tileKey(z, x, y), px, py, got, want)
+	}
+}
+
+// assertCorner checks the colour in the bottom right corner of a tile.
+func assertCorner(t *testing.T, s *memStore, z, x, y int, want color.RGBA) {
+	assertPixel(t, s, z, x, y, testTileSize-1, testTileSize-1, want)
+}
+
+func TestRenderFullBuild(t *testing.T) {
+	var dir = t.TempDir()
+	var s = newTestStore(t)
+	render(t, s, dir)
+
+	assertWritten(t, s, "1/0x0", "1/1x0", "1/0x1", "1/1x1", "0/0x0")
+	assertCorner(t, s, 0, 0, 0, color.RGBA{0, 0, 255, 255})
+
+	if _, err := os.Stat(filepath.Join(dir, "manifest.json")); err != nil {
+		t.Errorf("no manifest: %s", err)
+	}
+
+	if _, err := os.Stat(filepath.Join(dir, "manifest.json.partial")); !os.IsNotExist(err) {
+		t.Errorf("progress left behind after a finished render: %v", err)
+	}
+}
+
+func TestRenderIncremental(t *testing.T) {
+	var dir = t.TempDir()
+	var s = newTestStore(t)
+	render(t, s, dir)
+	s.written()
+
+	// Nothing changed, so nothing is built
+	render(t, s, dir)
+	assertWritten(t, s)
+
+	putSource(t, s, 3, 3, color.RGBA{255, 0, 0, 255})
+	render(t, s, dir)
+	assertWritten(t, s, "1/1x1", "0/0x0")
+	assertCorner(t, s, 1, 1, 1, color.RGBA{255, 0, 0, 255})
+	assertCorner(t, s, 0, 0, 0, color.RGBA{255, 0, 0, 255})
+}
+
+func TestRenderResume(t *testing.T) {
+	var dir = t.TempDir()
+	var s = newTestStore(t)
+
+	// Cancel part way through the first level
+	var ctx, cancel = context.WithCancel(context.Background())
+	var n int
+	s.onWrite = func() {
+		if n++; n == 2 {
+			cancel()
+		}
+	}
+
+	if err := newTestRenderer(s, dir).Render(ctx); err != context.Canceled {
+		t.Fatalf("got %v, want %v", err, context.Canceled)
+	}
+
+	s.onWrite = nil
+	var first = s.written()
+	if len(first) != 2 {
+		t.Fatalf("wrote %v before being cancelled, want 2 tiles", first)
+	}
+
+	if _, err := os.Stat(filepath.Join(dir, "manifest.json")); !os.IsNotExist(err) {
+		t.Errorf("manifest saved by a cancelled render: %v", err)
+	}
+
+	// Only the tile that was finished before the cancellation is skipped, the
+	// one being written as it happened might not be complete
+	render(t, s, dir, WithResume(true))
+	if first[0] != "1/0x0" || first[1] != "1/0x1" {
+		t.Fatalf("wrote %v before being cancelled, want 1/0x0 and 1/0x1", first)
+	}
+
+	assertWritten(t, s, "1/0x1", "1/1x0", "1/1x1", "0/0x0")
+
+	if _, err := os.Stat(filepath.Join(dir, "manifest.json.partial")); !os.IsNotExist(err) {
+		t.Errorf("progress left behind after a finished render: %v", err)
+	}
+}
+
+func TestRenderResumeRebuildsChangedTiles(t *testing.T) {
+	var dir = t.TempDir()
+	var s = newTestStore(t)
+	render(t, s, dir)
+	s.written()
+
+	// Every tile exists and decodes, but the ones over the changed source are stale
+	putSource(t, s, 0, 0, color.RGBA{255, 0, 0, 255})
+	render(t, s, dir, WithResume(true))
+	assertWritten(t, s, "1/0x0", "0/0x0")
+
+	// An interrupted render's progress doesn't count once the sources change.
+	// This one finishes 1x1 at zoom 1 and is cancelled while writing zoom 0
+	var ctx, cancel = context.WithCancel(context.Background())
+	var n int
+	putSource(t, s, 3, 3, color.RGBA{255, 0, 0, 255})
+	s.onWrite = func() {
+		if n++; n == 2 {
+			cancel()
+		}
+	}
+
+	if err := newTestRenderer(s, dir).Render(ctx); err != context.Canceled {
+		t.Fatalf("got %v, want %v", err, context.Canceled)
+	}
+
+	s.onWrite = nil
+	assertWritten(t, s, "1/1x1", "0/0x0")
+
+	putSource(t, s, 3, 3, color.RGBA{0, 255, 0, 255})
+	render(t, s, dir, WithResume(true))
+	assertWritten(t, s, "1/1x1", "0/0x0")
+	assertCorner(t, s, 1, 1, 1, color.RGBA{0, 255, 0, 255})
+}
+
+func TestRenderDeletedSources(t *testing.T) {
+	var dir = t.TempDir()
+	var s = newTestStore(t)
+	render(t, s, dir)
+
+	for _, p := range []image.Point{{2, 0}, {3, 0}, {2, 1}, {3, 1}} {
+		s.DeleteTile(2, p.X, p.Y)
+	}
+
+	s.written()
+	render(t, s, dir)
+	assertWritten(t, s, "0/0x0")
+
+	if s.has(1, 1, 0) {
+		t.Error("tile 1x0 at zoom 1 kept after all of its sources were deleted")
+	}
+
+	assertPixel(t, s, 0, 0, 0, testTileSize-1, 0, color.RGBA{0, 0, 0, 255})
+	assertCorner(t, s, 0, 0, 0, color.RGBA{0, 0, 255, 255})
+}
+
+// newCorruptStore returns the test store with source tile 0x0 replaced by
+// something that doesn't decode.
+func newCorruptStore(t *testing.T) *memStore {
+	var s = newTestStore(t)
+	s.tiles[tileKey(2, 0, 0)] = []byte("not an image")
+	return s
+}
+
+func TestRenderAbortOnError(t *testing.T) {
+	var dir = t.TempDir()
+	var s = newCorruptStore(t)
+
+	var err = newTestRenderer(s, dir, WithErrorPolicy(AbortOnError)).Render(context.Background())
+
+	var te *TileError
+	if !errors.As(err, &te) {
+		t.Fatalf("got %v, want a *TileError", err)
+	}
+
+	if te.Zoom != 1 || te.X != 0 || te.Y != 0 {
+		t.Errorf("tile %d/%dx%d failed, want 1/0x0", te.Zoom, te.X, te.Y)
+	}
+
+	// The corrupt tile is the first one built, so nothing else is started
+	assertWritten(t, s)
+
+	if _, err = os.Stat(filepath.Join(dir, "manifest.json")); !os.IsNotExist(err) {
+		t.Errorf("manifest saved by a failed render: %v", err)
+	}
+}
+
+func TestRenderSkipOnError(t *testing.T) {
+	var dir = t.TempDir()
+	var s = newCorruptStore(t)
+
+	var err = newTestRenderer(s, dir, WithErrorPolicy(SkipOnError)).Render(context.Background())
+
+	var re *RenderError
+	if !errors.As(err, &re) {
+		t.Fatalf("got %v, want a *RenderError", err)
+	}
+
+	if len(re.Tiles) != 1 || re.Tiles[0].Zoom != 1 || re.Tiles[0].X != 0 || re.Tiles[0].Y != 0 {
+		t.Errorf("got failures %v, want only 1/0x0", re.Tiles)
+	}
+
+	// Everything else is still built, with the failed tile left out of zoom 0
+	assertWritten(t, s, "1/1x0", "1/0x1", "1/1x1", "0/0x0")
+
+	if _, err = os.Stat(filepath.Join(dir, "manifest.json")); !os.IsNotExist(err) {
+		t.Errorf("manifest saved by a failed render: %v", err)
+	}
+}
+
+func TestRenderInvalidOptions(t *testing.T) {
+	var tests = []struct {
+		name string
+		opt  Option
+	}{
+		{"no concurrency", WithConcurrency(0)},
+		{"negative concurrency", WithConcurrency(-1)},
+		{"no tile size", WithTileSize(0)},
+		{"negative zoom", WithZoomRange(-1, 2)},
+		{"backwards zoom", WithZoomRange(3, 2)},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var r = NewRenderer(WithStore(newMemStore()), tt.opt)
+			if err := r.Render(context.Background()); err == nil {
+				t.Error("rendered with invalid options")
+			}
+		})
+	}
+}
@@ -0,0 +1,264 @@
+package maptorio
+
+import (
+	"archive/zip"
+	"bufio"
+	"compress/zlib"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+)
+
+// Version is a game or mod version: major, minor, patch and build. Mods don't
+// have a build number, so it's always 0 for them.
+type Version [4]uint16
+
+// ParseVersion parses a version like 0.15.40, with an optional build number.
+func ParseVersion(s string) (Version, error) {
+	var v Version
+	var parts = strings.Split(s, ".")
+	if len(parts) < 3 || len(parts) > 4 {
+		return v, fmt.Errorf("invalid version %s", s)
+	}
+
+	for i, part := range parts {
+		var n, err = strconv.ParseUint(part, 10, 16)
+		if err != nil {
+			return Version{}, fmt.Errorf("invalid version %s", s)
+		}
+
+		v[i] = uint16(n)
+	}
+
+	return v, nil
+}
+
+// Compare returns -1, 0 or 1 depending on whether v is older than, the same
+// as, or newer than o.
+func (v Version) Compare(o Version) int {
+	for i := range v {
+		if v[i] < o[i] {
+			return -1
+		} else if v[i] > o[i] {
+			return 1
+		}
+	}
+
+	return 0
+}
+
+// Release returns v without its build number, since build numbers differ
+// between platforms for the same release.
+func (v Version) Release() Version {
+	return Version{v[0], v[1], v[2]}
+}
+
+// String returns the version as major.minor.patch, leaving the build out.
+func (v Version) String() string {
+	return fmt.Sprintf("%d.%d.%d", v[0], v[1], v[2])
+}
+
+// SaveMod is a mod a save was made with.
+type SaveMod struct {
+	Name    string
+	Version Version
+	CRC     uint32
+}
+
+// SaveHeader is the part of a save's level data that describes it, which can
+// be read without loading the map.
+type SaveHeader struct {
+	// Version is the version of the game that wrote the save
+	Version Version
+
+	Campaign string
+	Level    string
+	BaseMod  string
+
+	Mods []SaveMod
+}
+
+// ReadSaveHeader reads the header from the save zip at path.
+func ReadSaveHeader(path string) (*SaveHeader, error) {
+	var z, err = zip.OpenReader(path)
+	if err != nil {
+		return nil, err
+	}
+	defer z.Close()
+
+	// Newer versions of the game split the level data into compressed chunks
+	// and put the header in a small file of its own
+	var level *zip.File
+	for _, name := range []string{"level-init.dat", "level.dat", "level.dat0"} {
+		for _, f := range z.File {
+			if f.Name == name || strings.HasSuffix(f.Name, "/"+name) {
+				level = f
+				break
+			}
+		}
+
+		if level != nil {
+			break
+		}
+	}
+
+	if level == nil {
+		return nil, fmt.Errorf("%s is not a save, it has no level data", path)
+	}
+
+	var rc io.ReadCloser
+	if rc, err = level.Open(); err != nil {
+		return nil, err
+	}
+	defer rc.Close()
+
+	// Only the start of the file is needed, but it may be compressed on top of the zip
+	var r = bufio.NewReader(rc)
+	var magic []byte
+	if magic, err = r.Peek(2); err == nil && magic[0] == 0x78 && (uint16(magic[0])<<8|uint16(magic[1]))%31 == 0 {
+		var zr io.ReadCloser
+		if zr, err = zlib.NewReader(r); err != nil {
+			return nil, err
+		}
+		defer zr.Close()
+
+		r = bufio.NewReader(zr)
+	}
+
+	var h *SaveHeader
+	if h, err = readSaveHeader(r); err != nil {
+		return nil, fmt.Errorf("error reading save header from %s: %s", path, err)
+	}
+
+	return h, nil
+}
+
+// saveReader reads the primitive types the level data is made of, keeping the
+// first error it runs into.
+type saveReader struct {
+	r       io.Reader
+	version Version
+	err     error
+}
+
+func (s *saveReader) read(v interface{}) {
+	if s.err == nil {
+		s.err = binary.Read(s.r, binary.LittleEndian, v)
+	}
+}
+
+func (s *saveReader) uint8() uint8 {
+	var v uint8
+	s.read(&v)
+	return v
+}
+
+func (s *saveReader) bool() bool {
+	return s.uint8() != 0
+}
+
+func (s *saveReader) uint16() uint16 {
+	var v uint16
+	s.read(&v)
+	return v
+}
+
+func (s *saveReader) uint32() uint32 {
+	var v uint32
+	s.read(&v)
+	return v
+}
+
+// optimized reads a number that's stored in a single byte when it's small
+// enough, and as 0xFF followed by the full number when it isn't.
+func (s *saveReader) optimized(size int) uint32 {
+	var b = s.uint8()
+	if b != 0xFF {
+		return uint32(b)
+	}
+
+	if size == 16 {
+		return uint32(s.uint16())
+	}
+
+	return s.uint32()
+}
+
+func (s *saveReader) string() string {
+	var n = s.optimized(32)
+	if s.err != nil {
+		return ""
+	}
+
+	var buf = make([]byte, n)
+	if _, err := io.ReadFull(s.r, buf); err != nil {
+		s.err = err
+	}
+
+	return string(buf)
+}
+
+// since reports whether the save was written by version major.minor.patch or
+// later.
+func (s *saveReader) since(major, minor, patch uint16) bool {
+	return s.version.Compare(Version{major, minor, patch}) >= 0
+}
+
+func readSaveHeader(r io.Reader) (*SaveHeader, error) {
+	var s = &saveReader{r: r}
+	var h = new(SaveHeader)
+
+	s.read(&h.Version)
+	s.version = h.Version
+	if s.err == nil && (h.Version[0] > 10 || h.Version == Version{}) {
+		return nil, fmt.Errorf("unrecognized version %d.%d.%d.%d", h.Version[0], h.Version[1], h.Version[2], h.Version[3])
+	}
+
+	if s.since(0, 17, 0) {
+		s.uint8()
+	}
+
+	h.Campaign = s.string()
+	h.Level = s.string()
+	h.BaseMod = s.string()
+
+	s.uint8()  // difficulty
+	s.bool()   // finished
+	s.bool()   // player won
+	s.string() // next level
+	s.bool()   // can continue
+	s.bool()   // finished but continuing
+	s.bool()   // saving replay
+
+	if s.since(0, 16, 0) {
+		s.bool() // allow non-admin debug options
+	}
+
+	// The version the map was first loaded from, then its build
+	s.optimized(16)
+	s.optimized(16)
+	s.optimized(16)
+	s.uint16()
+
+	s.uint8() // allowed commands
+
+	var n = s.optimized(32)
+	for i := uint32(0); i < n && s.err == nil; i++ {
+		var m SaveMod
+		m.Name = s.string()
+		m.Version[0] = uint16(s.optimized(16))
+		m.Version[1] = uint16(s.optimized(16))
+		m.Version[2] = uint16(s.optimized(16))
+		m.CRC = s.uint32()
+
+		h.Mods = append(h.Mods, m)
+	}
+
+	if s.err != nil {
+		return nil, s.err
+	}
+
+	return h, nil
+}
@@ -0,0 +1,231 @@
+package maptorio
+
+import (
+	"archive/zip"
+	"bytes"
+	"compress/zlib"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// The headers in testdata/headers are laid out the way each version of the
+// game writes them, followed by some of the map data that comes after.
+// 0.16 added a flag to the header and 0.17 a byte after the version, so
+// there's one from before each of those too.
+var headerFixtures = []struct {
+	file    string
+	version Version
+	mods    []string
+}{
+	{
+		file:    "0.15.40.dat",
+		version: Version{0, 15, 40, 0},
+		mods:    []string{"base 0.15.40 0b5e3a7d"},
+	},
+	{
+		file:    "0.16.51.dat",
+		version: Version{0, 16, 51, 0},
+		mods:    []string{"base 0.16.51 4c8f2e16", "Bottleneck 0.9.5 a71c0d93"},
+	},
+	{
+		file:    "0.17.79.dat",
+		version: Version{0, 17, 79, 49983},
+		mods:    []string{"base 0.17.79 d93e6a19", "Bottleneck 0.11.4 5c1f3e2a", "even-distribution 0.3.21 8a90b7c4"},
+	},
+	{
+		file:    "1.1.110.dat",
+		version: Version{1, 1, 110, 59000},
+		mods:    []string{"base 1.1.110 6f2c1d0e", "flib 0.12.9 1b3a7f55", "Krastorio2 1.3.24 e4c2a913"},
+	},
+	{
+		file:    "2.0.60.dat",
+		version: Version{2, 0, 60, 62000},
+		mods: []string{
+			"base 2.0.60 2a7d44c1", "elevated-rails 2.0.60 3b9e0a72", "quality 2.0.60 c05e1f38",
+			"space-age 2.0.60 71d4b6e9", "Bottleneck 0.12.1 9e3c5a07",
+		},
+	},
+}
+
+func readFixture(t *testing.T, file string) []byte {
+	var data, err = ioutil.ReadFile(filepath.Join("testdata", "headers", file))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return data
+}
+
+// writeTestSave writes a save to path with files in the save's directory.
+func writeTestSave(t *testing.T, path string, files map[string][]byte) {
+	var f, err = os.Create(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+
+	var z = zip.NewWriter(f)
+	for name, data := range files {
+		var w, zerr = z.Create("railworld/" + name)
+		if zerr != nil {
+			t.Fatal(zerr)
+		}
+
+		w.Write(data)
+	}
+
+	if err = z.Close(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// assertHeader checks h is a freeplay save made by version with mods.
+func assertHeader(t *testing.T, h *SaveHeader, version Version, mods []string) {
+	if h.Version != version {
+		t.Errorf("version %v, want %v", h.Version, version)
+	}
+
+	if h.Campaign != "" || h.Level != "freeplay" || h.BaseMod != "base" {
+		t.Errorf("scenario %q/%q with base mod %q, want freeplay and base", h.Campaign, h.Level, h.BaseMod)
+	}
+
+	var got []string
+	for _, m := range h.Mods {
+		got = append(got, fmt.Sprintf("%s %s %08x", m.Name, m.Version, m.CRC))
+	}
+
+	if fmt.Sprint(got) != fmt.Sprint(mods) {
+		t.Errorf("mods %v, want %v", got, mods)
+	}
+}
+
+func zlibBytes(t *testing.T, data []byte) []byte {
+	var buf bytes.Buffer
+	var zw = zlib.NewWriter(&buf)
+	zw.Write(data)
+	if err := zw.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	return buf.Bytes()
+}
+
+func TestReadSaveHeader(t *testing.T) {
+	// Where the header is depends on the version, and newer versions compress
+	// it inside the zip as well
+	var layouts = []struct {
+		name  string
+		files func(header []byte) map[string][]byte
+	}{
+		{"level.dat", func(h []byte) map[string][]byte {
+			return map[string][]byte{"level.dat": h}
+		}},
+		{"zlib level.dat", func(h []byte) map[string][]byte {
+			return map[string][]byte{"level.dat": zlibBytes(t, h)}
+		}},
+		{"level.dat0", func(h []byte) map[string][]byte {
+			return map[string][]byte{"level.dat0": zlibBytes(t, h), "level.dat1": zlibBytes(t, []byte("map"))}
+		}},
+		{"level-init.dat", func(h []byte) map[string][]byte {
+			return map[string][]byte{"level-init.dat": zlibBytes(t, h), "level.dat0": zlibBytes(t, []byte("map"))}
+		}},
+	}
+
+	for _, fx := range headerFixtures {
+		for _, l := range layouts {
+			t.Run(fx.file+"/"+l.name, func(t *testing.T) {
+				var path = filepath.Join(t.TempDir(), "railworld.zip")
+				writeTestSave(t, path, l.files(readFixture(t, fx.file)))
+
+				var h, err = ReadSaveHeader(path)
+				if err != nil {
+					t.Fatal(err)
+				}
+
+				assertHeader(t, h, fx.version, fx.mods)
+			})
+		}
+	}
+}
+
+func TestReadSaveHeaderErrors(t *testing.T) {
+	var header = readFixture(t, "1.1.110.dat")
+	var tests = []struct {
+		name  string
+		files map[string][]byte
+		err   string
+	}{
+		{"no level data", map[string][]byte{"control.lua": []byte("")}, "has no level data"},
+		{"truncated", map[string][]byte{"level.dat": header[:60]}, "error reading save header"},
+		{"unrecognized version", map[string][]byte{"level.dat": append([]byte{0, 0, 0, 0, 0, 0, 0, 0}, header[8:]...)}, "unrecognized version 0.0.0.0"},
+		{"not a version", map[string][]byte{"level.dat": []byte("PK\x03\x04 not a header")}, "unrecognized version"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var path = filepath.Join(t.TempDir(), "railworld.zip")
+			writeTestSave(t, path, tt.files)
+
+			if _, err := ReadSaveHeader(path); err == nil || !strings.Contains(err.Error(), tt.err) {
+				t.Errorf("got error %v, want one about %q", err, tt.err)
+			}
+		})
+	}
+
+	if _, err := ReadSaveHeader(filepath.Join(t.TempDir(), "missing.zip")); !os.IsNotExist(err) {
+		t.Errorf("got %v for a missing save, want it to not exist", err)
+	}
+}
+
+func TestParseVersion(t *testing.T) {
+	var tests = []struct {
+		in   string
+		want Version
+		err  bool
+	}{
+		{in: "0.15.40", want: Version{0, 15, 40, 0}},
+		{in: "2.0.60", want: Version{2, 0, 60, 0}},
+		{in: "1.1.110.59000", want: Version{1, 1, 110, 59000}},
+		{in: "65535.0.0", want: Version{65535, 0, 0, 0}},
+		{in: "1.1", err: true},
+		{in: "1.1.1.1.1", err: true},
+		{in: "1.x.1", err: true},
+		{in: "1.-1.1", err: true},
+		{in: "65536.0.0", err: true},
+		{in: "", err: true},
+	}
+
+	for _, tt := range tests {
+		var got, err = ParseVersion(tt.in)
+		if (err != nil) != tt.err || got != tt.want {
+			t.Errorf("ParseVersion(%q) = %v, %v", tt.in, got, err)
+		}
+	}
+}
+
+func TestVersionCompare(t *testing.T) {
+	var tests = []struct {
+		a, b Version
+		want int
+	}{
+		{Version{1, 1, 110}, Version{1, 1, 110}, 0},
+		{Version{1, 1, 110}, Version{2, 0, 60}, -1},
+		{Version{0, 17, 79}, Version{0, 16, 51}, 1},
+		{Version{1, 1, 9}, Version{1, 1, 10}, -1},
+		{Version{1, 1, 110, 59000}, Version{1, 1, 110, 58000}, 1},
+	}
+
+	for _, tt := range tests {
+		if got := tt.a.Compare(tt.b); got != tt.want {
+			t.Errorf("%v.Compare(%v) = %d, want %d", tt.a, tt.b, got, tt.want)
+		}
+	}
+
+	if v := (Version{1, 1, 110, 59000}); v.Release() != (Version{1, 1, 110}) || v.String() != "1.1.110" {
+		t.Errorf("%v is release %v, printed as %s", v, v.Release(), v.String())
+	}
+}
@@ -0,0 +1,240 @@
+package maptorio
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"image"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// ErrNoTile is returned by a Store when the requested tile does not exist.
+var ErrNoTile = errors.New("tile does not exist")
+
+// Store is where a Renderer reads its source tiles from and writes the tiles
+// it builds to. Tiles are passed around already encoded.
+type Store interface {
+	// ReadTile returns the encoded tile at x, y for zoom level z, or ErrNoTile
+	// if there isn't one.
+	ReadTile(z, x, y int) ([]byte, error)
+
+	// WriteTile stores the encoded tile at x, y for zoom level z. A failed or
+	// interrupted write must not leave a partial tile behind.
+	WriteTile(z, x, y int, data []byte) error
+
+	// DeleteTile removes the tile at x, y for zoom level z. Deleting a tile
+	// that doesn't exist is not an error.
+	DeleteTile(z, x, y int) error
+
+	// Tiles lists the coordinates of every tile at zoom level z.
+	Tiles(z int) ([]image.Point, error)
+}
+
+// DirStore is a Store that keeps each tile in its own file, laid out as
+// {z}/{x}x{y}.{ext} under a base directory, eg: tiles/nauvis. This is the
+// layout the game writes its screenshots in and the layout index.html reads
+// from.
+type DirStore struct {
+	dir string
+	ext string
+}
+
+// NewDirStore returns a DirStore rooted at dir for tiles with the file
+// extension ext, eg: "jpg".
+func NewDirStore(dir, ext string) *DirStore {
+	return &DirStore{dir: dir, ext: ext}
+}
+
+func (s *DirStore) path(z, x, y int) string {
+	return filepath.Join(s.dir, strconv.Itoa(z), fmt.Sprintf("%dx%d.%s", x, y, s.ext))
+}
+
+func (s *DirStore) ReadTile(z, x, y int) ([]byte, error) {
+	var data, err = ioutil.ReadFile(s.path(z, x, y))
+	if os.IsNotExist(err) {
+		return nil, ErrNoTile
+	}
+
+	return data, err
+}
+
+// WriteTile writes the tile to a temporary file and renames it into place, so
+// an interrupted render never leaves a partially written tile behind.
+func (s *DirStore) WriteTile(z, x, y int, data []byte) error {
+	// Make sure the directory exists first
+	var path = s.path(z, x, y)
+	if err := os.MkdirAll(filepath.Dir(path), os.ModePerm); err != nil {
+		return err
+	}
+
+	var tmp, err = ioutil.TempFile(filepath.Dir(path), ".tile-")
+	if err != nil {
+		return err
+	}
+
+	if _, err = tmp.Write(data); err == nil {
+		err = tmp.Chmod(0644)
+	}
+
+	if cerr := tmp.Close(); err == nil {
+		err = cerr
+	}
+
+	if err == nil {
+		err = os.Rename(tmp.Name(), path)
+	}
+
+	if err != nil {
+		os.Remove(tmp.Name())
+	}
+
+	return err
+}
+
+func (s *DirStore) DeleteTile(z, x, y int) error {
+	if err := os.Remove(s.path(z, x, y)); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+
+	return nil
+}
+
+func (s *DirStore) Tiles(z int) ([]image.Point, error) {
+	var d = filepath.Join(s.dir, strconv.Itoa(z))
+	var files, _ = filepath.Glob(filepath.Join(d, "*."+s.ext))
+
+	var tiles = make([]image.Point, 0, len(files))
+	for _, fp := range files {
+		var f = filepath.Base(fp)
+		f = strings.TrimSuffix(f, "."+s.ext)
+
+		var parts = strings.Split(f, "x")
+		if len(parts) != 2 {
+			return nil, fmt.Errorf("unexpected tile name %s", fp)
+		}
+
+		var x, errx = strconv.Atoi(parts[0])
+		var y, erry = strconv.Atoi(parts[1])
+		if errx != nil || erry != nil {
+			return nil, fmt.Errorf("unexpected tile name %s", fp)
+		}
+
+		tiles = append(tiles, image.Point{X: x, Y: y})
+	}
+
+	return tiles, nil
+}
+
+// Transcode re-encodes every tile at zoom level z in src from one format to
+// another and writes them to dst.
+func Transcode(ctx context.Context, src, dst Store, z int, from, to Format) error {
+	var tiles, err = src.Tiles(z)
+	if err != nil {
+		return err
+	}
+
+	for _, t := range tiles {
+		if err = ctx.Err(); err != nil {
+			return err
+		}
+
+		var data []byte
+		if data, err = src.ReadTile(z, t.X, t.Y); err != nil {
+			return err
+		}
+
+		var im image.Image
+		if im, err = from.Decode(bytes.NewReader(data)); err != nil {
+			return &TileError{Zoom: z, X: t.X, Y: t.Y, Err: err}
+		}
+
+		var buf = new(bytes.Buffer)
+		if err = to.Encode(buf, im); err != nil {
+			return &TileError{Zoom: z, X: t.X, Y: t.Y, Err: err}
+		}
+
+		if err = dst.WriteTile(z, t.X, t.Y, buf.Bytes()); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// CopyLevel makes zoom level z in dst match the same level in src, copying
+// every tile across as is and deleting any tile in dst that src doesn't have.
+func CopyLevel(ctx context.Context, dst, src Store, z int) error {
+	var tiles, err = src.Tiles(z)
+	if err != nil {
+		return err
+	}
+
+	var existing []image.Point
+	if existing, err = dst.Tiles(z); err != nil {
+		return err
+	}
+
+	var keep = make(map[image.Point]bool, len(tiles))
+	for _, t := range tiles {
+		if err = ctx.Err(); err != nil {
+			return err
+		}
+
+		var data []byte
+		if data, err = src.ReadTile(z, t.X, t.Y); err != nil {
+			return err
+		}
+
+		if err = dst.WriteTile(z, t.X, t.Y, data); err != nil {
+			return err
+		}
+
+		keep[t] = true
+	}
+
+	for _, t := range existing {
+		if keep[t] {
+			continue
+		}
+
+		if err = dst.DeleteTile(z, t.X, t.Y); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// Extent returns the lowest zoom level at or below maxZoom that has any tiles
+// in s, along with the area covered by the tiles at maxZoom.
+func Extent(s Store, maxZoom int) (int, image.Rectangle, error) {
+	var bounds image.Rectangle
+	var minZoom = maxZoom
+
+	for z := maxZoom; z >= 0; z-- {
+		var tiles, err = s.Tiles(z)
+		if err != nil {
+			return 0, bounds, err
+		}
+
+		if len(tiles) == 0 {
+			break
+		}
+
+		minZoom = z
+		if z != maxZoom {
+			continue
+		}
+
+		for _, t := range tiles {
+			bounds = bounds.Union(image.Rect(t.X, t.Y, t.X+1, t.Y+1))
+		}
+	}
+
+	return minZoom, bounds, nil
+}
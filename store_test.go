@@ -0,0 +1,83 @@
+package maptorio
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"image"
+	"sort"
+	"testing"
+)
+
+// sortedTiles returns the tiles at zoom z in s as a sorted list.
+func sortedTiles(t *testing.T, s Store, z int) []string {
+	var tiles, err = s.Tiles(z)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var out []string
+	for _, p := range tiles {
+		out = append(out, fmt.Sprintf("%dx%d", p.X, p.Y))
+	}
+
+	sort.Strings(out)
+	return out
+}
+
+func TestTranscode(t *testing.T) {
+	var src = NewDirStore(t.TempDir(), "png")
+	var tiles = []image.Point{{-1, -1}, {0, -1}, {3, 2}}
+	for _, p := range tiles {
+		var buf = new(bytes.Buffer)
+		if err := PNG.Encode(buf, quadrants()); err != nil {
+			t.Fatal(err)
+		}
+
+		if err := src.WriteTile(1, p.X, p.Y, buf.Bytes()); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// Another level is left alone
+	src.WriteTile(2, 0, 0, []byte("not an image"))
+
+	var dst = NewDirStore(t.TempDir(), "webp")
+	if err := Transcode(context.Background(), src, dst, 1, PNG, WebP); err != nil {
+		t.Fatal(err)
+	}
+
+	if got, want := sortedTiles(t, dst, 1), sortedTiles(t, src, 1); fmt.Sprint(got) != fmt.Sprint(want) {
+		t.Fatalf("transcoded %v, want %v", got, want)
+	}
+
+	if got := sortedTiles(t, dst, 2); len(got) != 0 {
+		t.Errorf("transcoded %v at zoom 2", got)
+	}
+
+	for _, p := range tiles {
+		var data, err = dst.ReadTile(1, p.X, p.Y)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		var im image.Image
+		if im, err = WebP.Decode(bytes.NewReader(data)); err != nil {
+			t.Fatalf("tile %v: %s", p, err)
+		}
+
+		assertSimilar(t, im, quadrants(), 0)
+	}
+
+	// A tile that doesn't decode is reported as the tile that failed
+	var err = Transcode(context.Background(), src, dst, 2, PNG, WebP)
+	if te, ok := err.(*TileError); !ok || te.Zoom != 2 || te.X != 0 || te.Y != 0 {
+		t.Errorf("got %v, want a *TileError for 2/0x0", err)
+	}
+
+	var ctx, cancel = context.WithCancel(context.Background())
+	cancel()
+	if err = Transcode(ctx, src, NewDirStore(t.TempDir(), "jpg"), 1, PNG, JPEG(0)); err != context.Canceled {
+		t.Errorf("got %v after being cancelled, want %v", err, context.Canceled)
+	}
+}